@@ -1,5 +1,7 @@
 package config
 
+import "time"
+
 type Config struct {
 	StaticDir string
 	SslMode   bool
@@ -7,4 +9,23 @@ type Config struct {
 	Port      string
 
 	TurnServerAddr string
+	// STUN server given to the peer connections of the SFU, none when
+	// empty.
+	StunServerAddr string
+
+	MaxRoomSize int
+	// Videos forwarded to each subscriber, zero forwards every video.
+	LastN         int
+	RecordingsDir string
+
+	// How long a user whose websocket dropped is kept in the room,
+	// waiting to resume. Zero removes the user straight away.
+	ResumeGracePeriod time.Duration
+
+	// Secret signing the room join tokens. Rooms are open to anyone
+	// when empty.
+	TokenSecret string
+	// Secret operators authenticate with. When empty the operator
+	// endpoints are only open if join tokens are not enabled.
+	OperatorSecret string
 }
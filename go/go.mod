@@ -5,12 +5,14 @@ go 1.14
 require (
 	github.com/alangpierce/go-forceexport v0.0.0-20160317203124-8f1d6941cd75 // indirect
 	github.com/golang/protobuf v1.4.3 // indirect
+	github.com/google/uuid v1.1.2
 	github.com/gorilla/mux v1.8.0
 	github.com/gorilla/websocket v1.4.2
 	github.com/lucas-clemente/quic-go v0.19.2 // indirect
 	github.com/marten-seemann/chacha20 v0.2.0 // indirect
 	github.com/pion/ice/v2 v2.0.13 // indirect
 	github.com/pion/rtcp v1.2.6
+	github.com/pion/rtp v1.6.1
 	github.com/pion/sdp/v2 v2.4.0 // indirect
 	github.com/pion/sdp/v3 v3.0.3
 	github.com/pion/transport v0.12.0 // indirect
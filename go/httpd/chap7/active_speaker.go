@@ -0,0 +1,114 @@
+package chap7
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// How often the room looks for a new active speaker.
+	activeSpeakerInterval = 300 * time.Millisecond
+	// Loudness (127 - audio level in -dBov) below which nobody is speaking.
+	activeSpeakerMinLoudness = 60
+	// A challenger must be this much louder than the current speaker...
+	activeSpeakerMargin = 5
+	// ... for this many intervals in a row to take over.
+	activeSpeakerIntervals = 2
+	// Levels not refreshed for this long are treated as silence.
+	activeSpeakerStaleAfter = 500 * time.Millisecond
+)
+
+type speakerLevel struct {
+	loudness   float64
+	lastUpdate time.Time
+}
+
+// activeSpeakerDetector picks the active speaker of a room out of the
+// RFC 6464 audio levels of its publishers.
+// Levels are smoothed and a speaker change needs a challenger to be
+// clearly louder for a few intervals, so short noises do not switch it.
+type activeSpeakerDetector struct {
+	mutex sync.Mutex
+
+	levels map[string]*speakerLevel
+
+	current    string
+	challenger string
+	wins       int
+}
+
+// observe records an audio level (0 loudest, 127 silence) from a user.
+func (d *activeSpeakerDetector) observe(userID string, level uint8) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	l, ok := d.levels[userID]
+	if !ok {
+		l = &speakerLevel{}
+		d.levels[userID] = l
+	}
+	l.loudness = l.loudness*0.8 + float64(127-level)*0.2
+	l.lastUpdate = time.Now()
+}
+
+func (d *activeSpeakerDetector) remove(userID string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	delete(d.levels, userID)
+	if d.current == userID {
+		d.current = ""
+	}
+}
+
+// detect returns the active speaker and whether it has changed since the
+// last call.
+func (d *activeSpeakerDetector) detect() (string, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	loudest := ""
+	loudestLevel := float64(activeSpeakerMinLoudness)
+	for userID, l := range d.levels {
+		if time.Since(l.lastUpdate) > activeSpeakerStaleAfter {
+			l.loudness = l.loudness * 0.5
+		}
+		if l.loudness >= loudestLevel {
+			loudest = userID
+			loudestLevel = l.loudness
+		}
+	}
+
+	if loudest == "" || loudest == d.current {
+		d.challenger = ""
+		d.wins = 0
+		return d.current, false
+	}
+
+	if current, ok := d.levels[d.current]; ok && loudestLevel < current.loudness+activeSpeakerMargin {
+		d.challenger = ""
+		d.wins = 0
+		return d.current, false
+	}
+
+	if d.challenger != loudest {
+		d.challenger = loudest
+		d.wins = 0
+	}
+	d.wins++
+
+	if d.wins < activeSpeakerIntervals && d.current != "" {
+		return d.current, false
+	}
+
+	d.current = loudest
+	d.challenger = ""
+	d.wins = 0
+	return d.current, true
+}
+
+func newActiveSpeakerDetector() *activeSpeakerDetector {
+	return &activeSpeakerDetector{
+		levels: map[string]*speakerLevel{},
+	}
+}
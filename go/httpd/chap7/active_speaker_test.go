@@ -0,0 +1,42 @@
+package chap7
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestActiveSpeakerDetector_detect(t *testing.T) {
+	d := newActiveSpeakerDetector()
+
+	// Nobody above the threshold.
+	d.observe("a", 120)
+	_, changed := d.detect()
+	assert.False(t, changed)
+
+	for i := 0; i < 20; i++ {
+		d.observe("a", 20)
+		d.observe("b", 100)
+	}
+	speaker, changed := d.detect()
+	assert.True(t, changed)
+	assert.Equal(t, "a", speaker)
+
+	// `b` takes over only after being louder for a few intervals.
+	for i := 0; i < 20; i++ {
+		d.observe("a", 100)
+		d.observe("b", 10)
+	}
+	speaker, changed = d.detect()
+	assert.False(t, changed)
+	assert.Equal(t, "a", speaker)
+
+	speaker, changed = d.detect()
+	assert.True(t, changed)
+	assert.Equal(t, "b", speaker)
+
+	d.remove("b")
+	speaker, changed = d.detect()
+	assert.False(t, changed)
+	assert.Equal(t, "", speaker)
+}
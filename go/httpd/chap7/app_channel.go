@@ -0,0 +1,105 @@
+package chap7
+
+import (
+	"errors"
+	"log"
+
+	"github.com/pion/webrtc/v3"
+)
+
+var ErrAppChannelNotOpen = errors.New("App data channel is not open")
+
+const (
+	// Data channels opened by the SFU to every user for the application
+	// messages. The unordered one does not retransmit, for state which is
+	// stale once a newer message is sent, like cursor positions.
+	appChannelLabel          = "app"
+	appUnorderedChannelLabel = "app-unordered"
+
+	// Bytes
+	maxAppMessageSize = 16 * 1024
+	// Messages are dropped for users which do not read them fast enough.
+	maxAppBufferedAmount = 1024 * 1024
+)
+
+// openAppChannels opens the ordered and unordered app data channels to
+// the user. The messages received on them are passed to `onMessage`. It
+// does nothing if they are open already.
+func (u *user) openAppChannels(onMessage func(ordered bool, payload []byte)) error {
+	u.appChannelsMutex.Lock()
+	defer u.appChannelsMutex.Unlock()
+
+	if u.appChannel != nil {
+		return nil
+	}
+
+	ordered, err := u.pc.CreateDataChannel(appChannelLabel, nil)
+	if err != nil {
+		return err
+	}
+
+	unordered, maxRetransmits := false, uint16(0)
+	unorderedChannel, err := u.pc.CreateDataChannel(appUnorderedChannelLabel, &webrtc.DataChannelInit{
+		Ordered:        &unordered,
+		MaxRetransmits: &maxRetransmits,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, dc := range []*webrtc.DataChannel{ordered, unorderedChannel} {
+		dc := dc
+		dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+			if len(msg.Data) > maxAppMessageSize {
+				log.Printf("Dropping app message of %d bytes from `%s`", len(msg.Data), u.ID)
+				return
+			}
+			onMessage(dc.Ordered(), msg.Data)
+		})
+	}
+
+	u.appChannel = ordered
+	u.appUnorderedChannel = unorderedChannel
+	return nil
+}
+
+// sendAppMessage sends the payload on the ordered or the unordered app
+// data channel of the user.
+func (u *user) sendAppMessage(ordered bool, payload []byte) error {
+	u.appChannelsMutex.Lock()
+	dc := u.appUnorderedChannel
+	if ordered {
+		dc = u.appChannel
+	}
+	u.appChannelsMutex.Unlock()
+
+	if dc == nil || dc.ReadyState() != webrtc.DataChannelStateOpen {
+		return ErrAppChannelNotOpen
+	}
+	if dc.BufferedAmount() > maxAppBufferedAmount {
+		log.Printf("Dropping app message to `%s`, %d bytes buffered", u.ID, dc.BufferedAmount())
+		return nil
+	}
+	return dc.Send(payload)
+}
+
+// appRecipients returns the users an app message from `from` goes to:
+// the users in `to`, or everybody else when it is empty.
+func appRecipients(users []*user, from *user, to []string) []*user {
+	targets := map[string]bool{}
+	for _, id := range to {
+		targets[id] = true
+	}
+
+	recipients := []*user{}
+	for _, u := range users {
+		if u.ID == from.ID {
+			continue
+		}
+		if len(targets) > 0 && !targets[u.ID] {
+			continue
+		}
+		recipients = append(recipients, u)
+	}
+	return recipients
+}
@@ -0,0 +1,30 @@
+package chap7
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// relayAppMessage forwards an app message received from a user to the
+// users it is for, on the channel of the same mode. The websocket is not
+// involved so app messages are not delayed by the signaling.
+func (s *chap7Handler) relayAppMessage(r *room, from *user, ordered bool, payload []byte) {
+	m := appMessage{}
+	if err := json.Unmarshal(payload, &m); err != nil {
+		log.Printf("Invalid app message from `%s`: %s", from.ID, err.Error())
+		return
+	}
+	m.From = from.ID
+
+	out, err := json.Marshal(&m)
+	if err != nil {
+		log.Print("Error: ", err.Error())
+		return
+	}
+
+	for _, recipient := range appRecipients(r.getUserList(), from, m.To) {
+		if err := recipient.sendAppMessage(ordered, out); err != nil && err != ErrAppChannelNotOpen {
+			log.Print("Error: ", err.Error())
+		}
+	}
+}
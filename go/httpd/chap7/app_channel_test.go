@@ -0,0 +1,16 @@
+package chap7
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAppRecipients(t *testing.T) {
+	a, b, c := &user{ID: "a"}, &user{ID: "b"}, &user{ID: "c"}
+	users := []*user{a, b, c}
+
+	assert.Equal(t, []*user{b, c}, appRecipients(users, a, nil))
+	assert.Equal(t, []*user{c}, appRecipients(users, a, []string{"c", "unknown"}))
+	assert.Equal(t, []*user{}, appRecipients(users, a, []string{"a"}))
+}
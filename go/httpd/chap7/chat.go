@@ -0,0 +1,71 @@
+package chap7
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrChatMessageNotFound = errors.New("Chat message not found")
+
+const (
+	// Room-wide messages kept for the users joining later.
+	maxChatHistory = 100
+	// Bytes
+	maxChatLength = 4096
+)
+
+// chatUser identifies the sender or recipient of a chat message as it was
+// when the message was sent. The history outlives the users in it.
+type chatUser struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+}
+
+func newChatUser(u *user) *chatUser {
+	return &chatUser{
+		ID:       u.ID,
+		Username: u.Username,
+	}
+}
+
+// chatMessage is a chat message relayed by the SFU, timestamped when it
+// is received.
+type chatMessage struct {
+	ID     string    `json:"id"`
+	From   *chatUser `json:"from"`
+	To     *chatUser `json:"to,omitempty"`
+	Text   string    `json:"text"`
+	SentAt time.Time `json:"sentAt"`
+}
+
+// addChatMessage keeps a room-wide message in the history, dropping the
+// oldest one when it is full.
+func (r *room) addChatMessage(m *chatMessage) {
+	r.chatMutex.Lock()
+	defer r.chatMutex.Unlock()
+
+	r.chatHistory = append(r.chatHistory, m)
+	if len(r.chatHistory) > maxChatHistory {
+		r.chatHistory = r.chatHistory[len(r.chatHistory)-maxChatHistory:]
+	}
+}
+
+func (r *room) deleteChatMessage(id string) error {
+	r.chatMutex.Lock()
+	defer r.chatMutex.Unlock()
+
+	for i, m := range r.chatHistory {
+		if m.ID == id {
+			r.chatHistory = append(r.chatHistory[:i:i], r.chatHistory[i+1:]...)
+			return nil
+		}
+	}
+	return ErrChatMessageNotFound
+}
+
+func (r *room) getChatHistory() []*chatMessage {
+	r.chatMutex.Lock()
+	defer r.chatMutex.Unlock()
+
+	return append([]*chatMessage{}, r.chatHistory...)
+}
@@ -0,0 +1,93 @@
+package chap7
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// handleChat relays a chat message to the room, or to a single user when
+// it is direct. Only room-wide messages go in the history.
+func (s *chap7Handler) handleChat(r *room, conn *websocket.Conn, payload []byte) error {
+	m := InChat{}
+	if err := json.Unmarshal(payload, &m); err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(m.Text) == "" || len(m.Text) > maxChatLength {
+		return s.sendMessage(r, conn, &InfoMessage{
+			Uri:     "out/error",
+			Code:    errCodeInvalid,
+			Message: fmt.Sprintf("chat messages must have between 1 and %d bytes", maxChatLength),
+		})
+	}
+
+	sender := r.getUser(conn)
+	message := &chatMessage{
+		ID:     uuid.New().String(),
+		From:   newChatUser(sender),
+		Text:   m.Text,
+		SentAt: time.Now(),
+	}
+	out := &OutChat{
+		Uri:     "out/chat",
+		Message: message,
+	}
+
+	if m.ToUserID == "" {
+		r.addChatMessage(message)
+		s.broadcast(r, out)
+		return nil
+	}
+
+	recipient := r.getUserByID(m.ToUserID)
+	if recipient == nil {
+		return s.sendMessage(r, conn, &InfoMessage{
+			Uri:     "out/error",
+			Code:    errCodeNotFound,
+			Message: ErrUserNotFound.Error(),
+		})
+	}
+	message.To = newChatUser(recipient)
+
+	// The sender gets its copy with the server id and timestamp.
+	s.sendToUser(r, recipient, out)
+	if recipient != sender {
+		return s.sendMessage(r, conn, out)
+	}
+	return nil
+}
+
+// handleChatDelete removes a room-wide message on behalf of a moderator.
+func (s *chap7Handler) handleChatDelete(r *room, conn *websocket.Conn, payload []byte) error {
+	m := InChatDelete{}
+	if err := json.Unmarshal(payload, &m); err != nil {
+		return err
+	}
+
+	if user := r.getUser(conn); user.Role != roleModerator {
+		return s.sendMessage(r, conn, &InfoMessage{
+			Uri:     "out/error",
+			Code:    errCodeForbidden,
+			Message: "Only moderators can delete chat messages",
+		})
+	}
+
+	if err := r.deleteChatMessage(m.MessageID); err != nil {
+		return s.sendMessage(r, conn, &InfoMessage{
+			Uri:     "out/error",
+			Code:    errCodeNotFound,
+			Message: err.Error(),
+		})
+	}
+
+	s.broadcast(r, &OutChatDeleted{
+		Uri:       "out/chat-deleted",
+		MessageID: m.MessageID,
+	})
+	return nil
+}
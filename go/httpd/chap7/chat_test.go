@@ -0,0 +1,39 @@
+package chap7
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoom_chatHistory(t *testing.T) {
+	r := newRoom("room", 2, 0)
+
+	for i := 0; i < maxChatHistory+5; i++ {
+		r.addChatMessage(&chatMessage{ID: fmt.Sprint(i)})
+	}
+
+	history := r.getChatHistory()
+	assert.Len(t, history, maxChatHistory)
+	assert.Equal(t, "5", history[0].ID)
+
+	assert.Nil(t, r.deleteChatMessage("6"))
+	assert.Equal(t, ErrChatMessageNotFound, r.deleteChatMessage("6"))
+
+	history = r.getChatHistory()
+	assert.Len(t, history, maxChatHistory-1)
+	assert.Equal(t, "7", history[1].ID)
+}
+
+func TestChatUser_snapshot(t *testing.T) {
+	u := &user{ID: "user", Username: "alice", Role: roleModerator}
+	m := &chatMessage{ID: "message", From: newChatUser(u)}
+
+	u.Username = "bob"
+
+	jData, err := json.Marshal(m)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"id": "message", "from": {"id": "user", "username": "alice"}, "text": "", "sentAt": "0001-01-01T00:00:00Z"}`, string(jData))
+}
@@ -0,0 +1,128 @@
+package chap7
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+
+	"github.com/pion/rtp/codecs"
+)
+
+var errUnsupportedCodec = errors.New("Unsupported codec")
+
+// depacketize returns the codec data in a video RTP payload and whether
+// the packet starts a frame.
+func depacketize(mimeType string, payload []byte) ([]byte, bool, error) {
+	switch strings.ToLower(mimeType) {
+	case mimeTypeVP8:
+		vp8 := codecs.VP8Packet{}
+		data, err := vp8.Unmarshal(payload)
+		if err != nil {
+			return nil, false, err
+		}
+		return data, vp8.S == 1 && vp8.PID == 0, nil
+	case mimeTypeVP9:
+		vp9 := codecs.VP9Packet{}
+		data, err := vp9.Unmarshal(payload)
+		if err != nil {
+			return nil, false, err
+		}
+		return data, vp9.B, nil
+	}
+	return nil, false, errUnsupportedCodec
+}
+
+// frameSize returns the dimensions of a VP8 or VP9 keyframe.
+func frameSize(mimeType string, frame []byte) (uint64, uint64, bool) {
+	switch strings.ToLower(mimeType) {
+	case mimeTypeVP8:
+		// Frame tag, start code and then 14 bits width and height.
+		if len(frame) < 10 || frame[3] != 0x9d || frame[4] != 0x01 || frame[5] != 0x2a {
+			return 0, 0, false
+		}
+		width := binary.LittleEndian.Uint16(frame[6:]) & 0x3fff
+		height := binary.LittleEndian.Uint16(frame[8:]) & 0x3fff
+		return uint64(width), uint64(height), true
+	case mimeTypeVP9:
+		return vp9FrameSize(frame)
+	}
+	return 0, 0, false
+}
+
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *bitReader) read(bits int) (uint64, bool) {
+	value := uint64(0)
+	for i := 0; i < bits; i++ {
+		if r.pos/8 >= len(r.data) {
+			return 0, false
+		}
+		bit := (r.data[r.pos/8] >> uint(7-r.pos%8)) & 0x01
+		value = value<<1 | uint64(bit)
+		r.pos++
+	}
+	return value, true
+}
+
+// vp9FrameSize reads the frame size off the uncompressed header of a VP9
+// keyframe.
+func vp9FrameSize(frame []byte) (uint64, uint64, bool) {
+	r := &bitReader{data: frame}
+
+	fields := []uint64{}
+	// frame_marker, profile_low_bit, profile_high_bit
+	for _, bits := range []int{2, 1, 1} {
+		value, ok := r.read(bits)
+		if !ok {
+			return 0, 0, false
+		}
+		fields = append(fields, value)
+	}
+	if fields[0] != 2 {
+		return 0, 0, false
+	}
+	profile := fields[2]<<1 | fields[1]
+	if profile == 3 {
+		r.read(1) // reserved_zero
+	}
+
+	// show_existing_frame, frame_type, show_frame, error_resilient_mode
+	if showExisting, ok := r.read(1); !ok || showExisting == 1 {
+		return 0, 0, false
+	}
+	if frameType, ok := r.read(1); !ok || frameType != 0 {
+		return 0, 0, false
+	}
+	r.read(2)
+
+	if syncCode, ok := r.read(24); !ok || syncCode != 0x498342 {
+		return 0, 0, false
+	}
+
+	// color_config
+	if profile >= 2 {
+		r.read(1) // ten_or_twelve_bit
+	}
+	colorSpace, _ := r.read(3)
+	if colorSpace != 7 { // CS_RGB
+		r.read(1) // color_range
+		if profile == 1 || profile == 3 {
+			r.read(3) // subsampling_x, subsampling_y, reserved_zero
+		}
+	} else if profile == 1 || profile == 3 {
+		r.read(1) // reserved_zero
+	}
+
+	width, ok := r.read(16)
+	if !ok {
+		return 0, 0, false
+	}
+	height, ok := r.read(16)
+	if !ok {
+		return 0, 0, false
+	}
+	return width + 1, height + 1, true
+}
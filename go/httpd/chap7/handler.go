@@ -17,6 +17,8 @@ var upgrader = websocket.Upgrader{
 }
 
 type chap7Handler struct {
+	cfg *config.Config
+
 	userFactory *userFactory
 	roomFactory *roomFactory
 }
@@ -35,14 +37,34 @@ func (s *chap7Handler) sendMessage(r *room, conn *websocket.Conn, payload interf
 	return conn.WriteMessage(websocket.TextMessage, jData)
 }
 
+// sendToUser sends the payload on the user connection. Messages to a
+// detached user are dropped, it gets the room state back on resume.
+func (s *chap7Handler) sendToUser(r *room, user *user, payload interface{}) error {
+	conn := user.getConn()
+	if conn == nil {
+		return nil
+	}
+	return s.sendMessage(r, conn, payload)
+}
+
 func (s *chap7Handler) RegisterHandlers(m *mux.Router, middleware func(h http.HandlerFunc) http.HandlerFunc) {
 	m.HandleFunc("/ws", s.RoomWS)
 	m.HandleFunc("/rooms", s.OperatorWS)
+	m.HandleFunc("/stats", s.RoomStats)
+	m.HandleFunc("/tokens", s.MintToken).Methods(http.MethodPost)
+	m.HandleFunc("/whip", s.WHIPPublish).Methods(http.MethodPost)
+	m.HandleFunc("/whip/{room}/{resource}", s.WHIPResource).Methods(http.MethodPatch, http.MethodDelete)
+	m.HandleFunc("/whep", s.WHEPPlay).Methods(http.MethodPost)
+	m.HandleFunc("/whep/{room}/{resource}", s.WHEPResource).Methods(http.MethodPatch, http.MethodDelete)
 }
 
 func New(cfg *config.Config) *chap7Handler {
-	return &chap7Handler{
+	s := &chap7Handler{
+		cfg: cfg,
+
 		userFactory: newUserFactory(cfg),
 		roomFactory: newRoomFactory(cfg),
 	}
+	s.roomFactory.onActiveSpeaker = s.handleActiveSpeaker
+	return s
 }
@@ -0,0 +1,76 @@
+package chap7
+
+import "github.com/pion/rtp"
+
+// jitterBuffer puts packets back in sequence number order.
+// Packets are held until the gap before them is filled or the buffer grows
+// past its size, in which case the missing packets are given up on.
+// It is not safe for concurrent use.
+type jitterBuffer struct {
+	size    int
+	packets map[uint16]*rtp.Packet
+
+	started bool
+	next    uint16
+}
+
+// push adds a packet and returns the packets which are now in order.
+func (j *jitterBuffer) push(packet *rtp.Packet) []*rtp.Packet {
+	if !j.started {
+		j.started = true
+		j.next = packet.SequenceNumber
+	}
+
+	if int16(packet.SequenceNumber-j.next) < 0 {
+		// Too late, the buffer has moved on.
+		return nil
+	}
+	j.packets[packet.SequenceNumber] = packet
+
+	ready := j.pop()
+	if len(j.packets) > j.size {
+		// Skip the gap up to the oldest packet held.
+		oldest := packet.SequenceNumber
+		for sequenceNumber := range j.packets {
+			if int16(sequenceNumber-oldest) < 0 {
+				oldest = sequenceNumber
+			}
+		}
+		j.next = oldest
+		ready = append(ready, j.pop()...)
+	}
+	return ready
+}
+
+// flush returns every packet held, in order.
+func (j *jitterBuffer) flush() []*rtp.Packet {
+	ready := []*rtp.Packet{}
+	for len(j.packets) > 0 {
+		if _, ok := j.packets[j.next]; !ok {
+			j.next++
+			continue
+		}
+		ready = append(ready, j.pop()...)
+	}
+	return ready
+}
+
+func (j *jitterBuffer) pop() []*rtp.Packet {
+	ready := []*rtp.Packet{}
+	for {
+		packet, ok := j.packets[j.next]
+		if !ok {
+			return ready
+		}
+		delete(j.packets, j.next)
+		ready = append(ready, packet)
+		j.next++
+	}
+}
+
+func newJitterBuffer(size int) *jitterBuffer {
+	return &jitterBuffer{
+		size:    size,
+		packets: map[uint16]*rtp.Packet{},
+	}
+}
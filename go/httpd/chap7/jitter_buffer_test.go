@@ -0,0 +1,50 @@
+package chap7
+
+import (
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+)
+
+func sequenceNumbers(packets []*rtp.Packet) []uint16 {
+	numbers := []uint16{}
+	for _, packet := range packets {
+		numbers = append(numbers, packet.SequenceNumber)
+	}
+	return numbers
+}
+
+func packetWithSequence(sequenceNumber uint16) *rtp.Packet {
+	return &rtp.Packet{Header: rtp.Header{SequenceNumber: sequenceNumber}}
+}
+
+func TestJitterBuffer_reorders(t *testing.T) {
+	j := newJitterBuffer(10)
+
+	assert.Equal(t, []uint16{65535}, sequenceNumbers(j.push(packetWithSequence(65535))))
+	assert.Empty(t, j.push(packetWithSequence(1)))
+	assert.Equal(t, []uint16{0, 1}, sequenceNumbers(j.push(packetWithSequence(0))))
+
+	// Late packets are dropped.
+	assert.Empty(t, j.push(packetWithSequence(65535)))
+}
+
+func TestJitterBuffer_skipsGapWhenFull(t *testing.T) {
+	j := newJitterBuffer(2)
+
+	j.push(packetWithSequence(1))
+	assert.Empty(t, j.push(packetWithSequence(3)))
+	assert.Empty(t, j.push(packetWithSequence(4)))
+	assert.Equal(t, []uint16{3, 4, 5}, sequenceNumbers(j.push(packetWithSequence(5))))
+}
+
+func TestJitterBuffer_flush(t *testing.T) {
+	j := newJitterBuffer(10)
+
+	j.push(packetWithSequence(1))
+	j.push(packetWithSequence(4))
+	j.push(packetWithSequence(3))
+
+	assert.Equal(t, []uint16{3, 4}, sequenceNumbers(j.flush()))
+}
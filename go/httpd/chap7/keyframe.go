@@ -0,0 +1,71 @@
+package chap7
+
+import (
+	"strings"
+
+	"github.com/pion/rtp/codecs"
+)
+
+const (
+	h264NALUTypeIDR   = 5
+	h264NALUTypeSPS   = 7
+	h264NALUTypeSTAPA = 24
+	h264NALUTypeFUA   = 28
+)
+
+// isKeyframe reports whether the RTP payload is the first packet of a
+// keyframe for the given codec mime type.
+func isKeyframe(mimeType string, payload []byte) bool {
+	switch strings.ToLower(mimeType) {
+	case mimeTypeVP8:
+		vp8 := codecs.VP8Packet{}
+		if _, err := vp8.Unmarshal(payload); err != nil {
+			return false
+		}
+		// The P bit of the VP8 frame tag is zero for keyframes.
+		return vp8.S == 1 && vp8.PID == 0 && vp8.Payload[0]&0x01 == 0
+	case mimeTypeVP9:
+		vp9 := codecs.VP9Packet{}
+		if _, err := vp9.Unmarshal(payload); err != nil {
+			return false
+		}
+		return vp9.B && !vp9.P
+	case mimeTypeH264:
+		return isH264Keyframe(payload)
+	case mimeTypeOpus:
+		// Every audio packet decodes on its own.
+		return true
+	}
+	return false
+}
+
+func isH264Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+
+	switch naluType := payload[0] & 0x1F; naluType {
+	case h264NALUTypeIDR, h264NALUTypeSPS:
+		return true
+	case h264NALUTypeSTAPA:
+		// Aggregation packet, look into each of the NAL units.
+		for i := 1; i+2 < len(payload); {
+			size := int(payload[i])<<8 | int(payload[i+1])
+			i += 2
+			if i >= len(payload) {
+				break
+			}
+			if t := payload[i] & 0x1F; t == h264NALUTypeIDR || t == h264NALUTypeSPS {
+				return true
+			}
+			i += size
+		}
+	case h264NALUTypeFUA:
+		// Fragmented unit, only the start fragment counts.
+		if len(payload) < 2 {
+			return false
+		}
+		return payload[1]&0x80 != 0 && payload[1]&0x1F == h264NALUTypeIDR
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package chap7
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var ErrLobbyRequestNotFound = errors.New("Lobby request not found")
+
+// lobbyRequest is a connection waiting in the lobby for a moderator or an
+// operator to let it in the room.
+type lobbyRequest struct {
+	ID        string    `json:"id"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"createdAt"`
+
+	conn     *websocket.Conn
+	role     string
+	streamID string
+}
+
+// needsAdmission tells whether a user with the role goes through the lobby.
+func (r *room) needsAdmission(role string) bool {
+	return r.lobbyEnabled && role != roleModerator
+}
+
+func (r *room) addToLobby(req *lobbyRequest) error {
+	r.lobbyMutex.Lock()
+	defer r.lobbyMutex.Unlock()
+
+	if r.closed {
+		return ErrRoomClosed
+	}
+	r.lobby[req.ID] = req
+	return nil
+}
+
+// takeFromLobby removes the request from the lobby. Only one of concurrent
+// decisions on a request gets it.
+func (r *room) takeFromLobby(id string) *lobbyRequest {
+	r.lobbyMutex.Lock()
+	defer r.lobbyMutex.Unlock()
+
+	req := r.lobby[id]
+	delete(r.lobby, id)
+	return req
+}
+
+// removeFromLobby removes the request of a connection, if it is waiting.
+func (r *room) removeFromLobby(conn *websocket.Conn) *lobbyRequest {
+	r.lobbyMutex.Lock()
+	defer r.lobbyMutex.Unlock()
+
+	for id, req := range r.lobby {
+		if req.conn == conn {
+			delete(r.lobby, id)
+			return req
+		}
+	}
+	return nil
+}
+
+func (r *room) inLobby(conn *websocket.Conn) bool {
+	r.lobbyMutex.Lock()
+	defer r.lobbyMutex.Unlock()
+
+	for _, req := range r.lobby {
+		if req.conn == conn {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *room) getLobby() []*lobbyRequest {
+	r.lobbyMutex.Lock()
+	defer r.lobbyMutex.Unlock()
+
+	lobby := []*lobbyRequest{}
+	for _, req := range r.lobby {
+		lobby = append(lobby, req)
+	}
+	return lobby
+}
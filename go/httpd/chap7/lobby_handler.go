@@ -0,0 +1,127 @@
+package chap7
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// enterLobby puts the connection in the lobby and asks the moderators and
+// operators to let it in.
+func (s *chap7Handler) enterLobby(r *room, conn *websocket.Conn, username, role, streamID string) error {
+	req := &lobbyRequest{
+		ID:        uuid.New().String(),
+		Username:  username,
+		CreatedAt: time.Now(),
+
+		conn:     conn,
+		role:     role,
+		streamID: streamID,
+	}
+	if err := r.addToLobby(req); err != nil {
+		return s.sendMessage(r, conn, &InfoMessage{
+			Uri:     "out/error",
+			Code:    errCodeRoomClosed,
+			Message: err.Error(),
+		})
+	}
+
+	log.Printf("`%s` waiting in the lobby of room `%s`", username, r.ID)
+
+	s.notifyLobby(r, "out/lobby-request", req)
+
+	return s.sendMessage(r, conn, &OutLobbyWaiting{
+		Uri:     "out/lobby-waiting",
+		LobbyID: req.ID,
+	})
+}
+
+// notifyLobby sends a lobby event to the moderators of the room and the
+// operators watching it.
+func (s *chap7Handler) notifyLobby(r *room, eventURI string, req *lobbyRequest) {
+	m := &OutLobbyEvent{
+		Uri:     eventURI,
+		RoomID:  r.ID,
+		Request: req,
+	}
+	for _, user := range r.getUserList() {
+		if user.Role == roleModerator {
+			s.sendToUser(r, user, m)
+		}
+	}
+
+	s.roomFactory.notifyRoomEvent(&OutOperatorRoomEvent{
+		Uri:    eventURI,
+		RoomID: r.ID,
+		Lobby:  req,
+	})
+}
+
+// admitFromLobby lets a waiting connection join the room.
+func (s *chap7Handler) admitFromLobby(r *room, id string) error {
+	req := r.takeFromLobby(id)
+	if req == nil {
+		return ErrLobbyRequestNotFound
+	}
+
+	s.notifyLobby(r, "out/lobby-admitted", req)
+	return s.joinRoom(r, req.conn, req.Username, req.role, req.streamID)
+}
+
+// denyFromLobby turns a waiting connection away.
+func (s *chap7Handler) denyFromLobby(r *room, id string) error {
+	req := r.takeFromLobby(id)
+	if req == nil {
+		return ErrLobbyRequestNotFound
+	}
+
+	s.notifyLobby(r, "out/lobby-denied", req)
+
+	s.sendMessage(r, req.conn, &InfoMessage{
+		Uri:     "out/lobby-denied",
+		Message: "You have not been let in the room",
+	})
+	return req.conn.Close()
+}
+
+// handleLobbyDecision admits or denies a lobby request on behalf of a
+// moderator in the room.
+func (s *chap7Handler) handleLobbyDecision(r *room, conn *websocket.Conn, payload []byte) error {
+	m := InLobbyDecision{}
+	if err := json.Unmarshal(payload, &m); err != nil {
+		return err
+	}
+
+	if user := r.getUser(conn); user.Role != roleModerator {
+		return s.sendMessage(r, conn, &InfoMessage{
+			Uri:     "out/error",
+			Code:    errCodeForbidden,
+			Message: "Only moderators can let users in",
+		})
+	}
+
+	var err error
+	if m.Uri == "in/admit" {
+		err = s.admitFromLobby(r, m.LobbyID)
+	} else {
+		err = s.denyFromLobby(r, m.LobbyID)
+	}
+	if err == ErrLobbyRequestNotFound {
+		return s.sendMessage(r, conn, &InfoMessage{
+			Uri:     "out/error",
+			Code:    errCodeNotFound,
+			Message: err.Error(),
+		})
+	}
+	return err
+}
+
+func (s *chap7Handler) admitUser(op *operator, r *room, m *InOperatorCommand) error {
+	if m.Uri == "in/admit" {
+		return s.admitFromLobby(r, m.LobbyID)
+	}
+	return s.denyFromLobby(r, m.LobbyID)
+}
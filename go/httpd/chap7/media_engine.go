@@ -12,7 +12,15 @@ const (
 	mimeTypeVP9  = "video/vp9"
 )
 
-var videoRTCPFeedback = []webrtc.RTCPFeedback{{"goog-remb", ""}, {"ccm", "fir"}, {"nack", ""}, {"nack", "pli"}}
+// RFC 6464 client-to-mixer audio level, used for active speaker detection.
+const audioLevelURI = "urn:ietf:params:rtp-hdrext:ssrc-audio-level"
+
+var videoRTCPFeedback = []webrtc.RTCPFeedback{
+	{Type: "goog-remb"},
+	{Type: "ccm", Parameter: "fir"},
+	{Type: "nack"},
+	{Type: "nack", Parameter: "pli"},
+}
 
 var videoRTPCodecs = []webrtc.RTPCodecParameters{
 	{
@@ -82,6 +90,10 @@ func getPublisherMediaEngine() (*webrtc.MediaEngine, error) {
 		}
 	}
 
+	if err := me.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: audioLevelURI}, webrtc.RTPCodecTypeAudio); err != nil {
+		return nil, err
+	}
+
 	return me, nil
 }
 
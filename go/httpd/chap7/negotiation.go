@@ -0,0 +1,60 @@
+package chap7
+
+import (
+	"sync"
+)
+
+// negotiationQueue runs the signaling operations of a user one at a time,
+// in the order they were queued, so offers and answers never interleave.
+//
+// Collisions follow "perfect negotiation" with the SFU as the impolite
+// peer, as pion can not roll an offer back: it ignores client offers while
+// it has one of its own pending. The client is the polite peer and rolls
+// its own offer back to answer the SFU.
+type negotiationQueue struct {
+	mutex   sync.Mutex
+	ops     []func()
+	running bool
+}
+
+// enqueue queues `op` without waiting for it to run. It is safe to call
+// from pion callbacks.
+func (q *negotiationQueue) enqueue(op func()) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.ops = append(q.ops, op)
+	if !q.running {
+		q.running = true
+		go q.run()
+	}
+}
+
+// do queues `op` and waits for its result.
+func (q *negotiationQueue) do(op func() error) error {
+	errc := make(chan error, 1)
+	q.enqueue(func() {
+		errc <- op()
+	})
+	return <-errc
+}
+
+func (q *negotiationQueue) run() {
+	for {
+		q.mutex.Lock()
+		if len(q.ops) == 0 {
+			q.running = false
+			q.mutex.Unlock()
+			return
+		}
+		op := q.ops[0]
+		q.ops = q.ops[1:]
+		q.mutex.Unlock()
+
+		op()
+	}
+}
+
+func newNegotiationQueue() *negotiationQueue {
+	return &negotiationQueue{}
+}
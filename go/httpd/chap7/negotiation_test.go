@@ -0,0 +1,31 @@
+package chap7
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiationQueue_runsInOrder(t *testing.T) {
+	q := newNegotiationQueue()
+
+	mutex := sync.Mutex{}
+	order := []int{}
+	for i := 0; i < 10; i++ {
+		i := i
+		q.enqueue(func() {
+			mutex.Lock()
+			defer mutex.Unlock()
+			order = append(order, i)
+		})
+	}
+
+	err := errors.New("failed")
+	assert.Equal(t, err, q.do(func() error {
+		return err
+	}))
+
+	assert.Equal(t, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, order)
+}
@@ -1,6 +1,8 @@
 package chap7
 
 import (
+	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 
@@ -9,6 +11,281 @@ import (
 	"github.com/andrefsp/video-democry/go/httpd/responses"
 )
 
+var (
+	ErrRoomNotFound   = errors.New("Room not found")
+	ErrUserNotFound   = errors.New("User not found")
+	ErrUnknownCommand = errors.New("Unknown command")
+)
+
+// operator is an operator connection and its room factory subscription.
+type operator struct {
+	conn   *websocket.Conn
+	events *eventSubscription
+}
+
+type operatorCommand func(s *chap7Handler, op *operator, r *room, m *InOperatorCommand) error
+
+var operatorCommands = map[string]operatorCommand{
+	"in/kick":         (*chap7Handler).kickUser,
+	"in/mute":         (*chap7Handler).muteUser,
+	"in/unmute":       (*chap7Handler).muteUser,
+	"in/lock":         (*chap7Handler).lockRoom,
+	"in/unlock":       (*chap7Handler).lockRoom,
+	"in/close":        (*chap7Handler).closeRoom,
+	"in/set-capacity": (*chap7Handler).setRoomCapacity,
+	"in/watch-room":   (*chap7Handler).watchRoom,
+	"in/unwatch-room": (*chap7Handler).watchRoom,
+	"in/stats":        (*chap7Handler).sendRoomStats,
+	"in/admit":        (*chap7Handler).admitUser,
+	"in/deny":         (*chap7Handler).admitUser,
+	"in/promote":      (*chap7Handler).stageUser,
+	"in/demote":       (*chap7Handler).stageUser,
+}
+
+func (s *chap7Handler) broadcast(r *room, payload interface{}) {
+	for _, uconn := range r.getUserConnections() {
+		s.sendMessage(r, uconn, payload)
+	}
+}
+
+// kickUser closes the user connection, which takes it out of the room.
+func (s *chap7Handler) kickUser(op *operator, r *room, m *InOperatorCommand) error {
+	conn := r.getUserConn(m.UserID)
+	if conn == nil {
+		return ErrUserNotFound
+	}
+	user := r.getUser(conn)
+
+	s.sendToUser(r, user, &InfoMessage{
+		Uri:     "out/kicked",
+		Message: "You have been removed from the room",
+	})
+
+	// Removed straight away, a kicked user can not resume.
+	s.handleRoomDisconnection(r, conn)
+	if user.ingest {
+		return nil
+	}
+	return conn.Close()
+}
+
+func (s *chap7Handler) muteUser(op *operator, r *room, m *InOperatorCommand) error {
+	user := r.getUserByID(m.UserID)
+	if user == nil {
+		return ErrUserNotFound
+	}
+
+	muted := m.Uri == "in/mute"
+	if err := user.setMuted(m.Kind, muted); err != nil {
+		return err
+	}
+
+	eventURI := "out/unmuted"
+	if muted {
+		eventURI = "out/muted"
+	}
+	s.broadcast(r, &OutMuteEvent{
+		Uri:  eventURI,
+		User: user,
+		Kind: m.Kind,
+	})
+	return nil
+}
+
+func (s *chap7Handler) lockRoom(op *operator, r *room, m *InOperatorCommand) error {
+	locked := m.Uri == "in/lock"
+	r.setLocked(locked)
+
+	eventURI := "out/room-unlocked"
+	if locked {
+		eventURI = "out/room-locked"
+	}
+	s.broadcast(r, &OutRoomEvent{
+		Uri:    eventURI,
+		RoomID: r.ID,
+	})
+	return nil
+}
+
+// closeRoom turns the lobby away and disconnects every user. The room is
+// deleted once the last one is gone.
+func (s *chap7Handler) closeRoom(op *operator, r *room, m *InOperatorCommand) error {
+	r.setLocked(true)
+
+	for _, req := range r.getLobby() {
+		if err := s.denyFromLobby(r, req.ID); err != nil && err != ErrLobbyRequestNotFound {
+			log.Print("Error: ", err.Error())
+		}
+	}
+
+	s.broadcast(r, &OutRoomEvent{
+		Uri:    "out/room-closed",
+		RoomID: r.ID,
+	})
+	for _, uconn := range r.getConnections() {
+		user := r.getUser(uconn)
+		s.handleRoomDisconnection(r, uconn)
+		if user != nil && !user.ingest {
+			uconn.Close()
+		}
+	}
+	return nil
+}
+
+func (s *chap7Handler) setRoomCapacity(op *operator, r *room, m *InOperatorCommand) error {
+	if err := r.setCapacity(m.Capacity); err != nil {
+		return err
+	}
+
+	s.broadcast(r, &OutRoomEvent{
+		Uri:      "out/room-capacity",
+		RoomID:   r.ID,
+		Capacity: m.Capacity,
+	})
+	return nil
+}
+
+// watchRoom sends the room detail to the operator, followed by the room
+// events until the room is unwatched.
+func (s *chap7Handler) watchRoom(op *operator, r *room, m *InOperatorCommand) error {
+	watch := m.Uri == "in/watch-room"
+	op.events.watch(r.ID, watch)
+	if !watch {
+		return nil
+	}
+
+	return s.sendMessage(nil, op.conn, &OutRoomDetail{
+		Uri:       "out/room-detail",
+		RequestID: m.RequestID,
+		Room:      r.getDetail(),
+	})
+}
+
+// getRoomStats returns the stats of the room, only of the given user if
+// `userID` is set.
+func getRoomStats(r *room, userID string) (*roomStats, error) {
+	stats := r.getStats()
+	if userID == "" {
+		return stats, nil
+	}
+
+	for _, us := range stats.Users {
+		if us.ID == userID {
+			stats.Users = []*userStats{us}
+			return stats, nil
+		}
+	}
+	return nil, ErrUserNotFound
+}
+
+func (s *chap7Handler) sendRoomStats(op *operator, r *room, m *InOperatorCommand) error {
+	stats, err := getRoomStats(r, m.UserID)
+	if err != nil {
+		return err
+	}
+
+	return s.sendMessage(nil, op.conn, &OutStats{
+		Uri:       "out/stats",
+		RequestID: m.RequestID,
+		Stats:     stats,
+	})
+}
+
+// RoomStats serves the media stats of a room as JSON.
+func (s *chap7Handler) RoomStats(w http.ResponseWriter, r *http.Request) {
+	if !s.isOperator(r) {
+		responses.Send(w, http.StatusUnauthorized, responses.NewError("unauthorized"))
+		return
+	}
+
+	roomID := r.URL.Query().Get("room")
+	if roomID == "" {
+		responses.Send(w, http.StatusBadRequest, responses.NewError("room not present on request"))
+		return
+	}
+
+	room := s.roomFactory.get(roomID)
+	if room == nil {
+		responses.Send(w, http.StatusNotFound, responses.NewError(ErrRoomNotFound.Error()))
+		return
+	}
+
+	stats, err := getRoomStats(room, r.URL.Query().Get("user"))
+	if err != nil {
+		responses.Send(w, http.StatusNotFound, responses.NewError(err.Error()))
+		return
+	}
+
+	responses.Send(w, http.StatusOK, stats)
+}
+
+// notifyOperators sends a room event to the operators watching the room.
+func (s *chap7Handler) notifyOperators(r *room, eventURI string, user *user, track *trackDetail) {
+	m := &OutOperatorRoomEvent{
+		Uri:    eventURI,
+		RoomID: r.ID,
+		UserID: user.ID,
+		Track:  track,
+	}
+	if eventURI == "out/user-joined" {
+		m.Participant = user.getDetail()
+	}
+	s.roomFactory.notifyRoomEvent(m)
+}
+
+func operatorErrorCode(err error) string {
+	switch err {
+	case ErrRoomNotFound, ErrUserNotFound, ErrLobbyRequestNotFound:
+		return errCodeNotFound
+	case ErrUnknownCommand:
+		return errCodeUnknownURI
+	}
+	return errCodeInvalid
+}
+
+func (s *chap7Handler) runOperatorCommand(op *operator, m *InOperatorCommand) error {
+	command, ok := operatorCommands[m.Uri]
+	if !ok {
+		return ErrUnknownCommand
+	}
+
+	r := s.roomFactory.get(m.RoomID)
+	if r == nil {
+		return ErrRoomNotFound
+	}
+
+	return command(s, op, r, m)
+}
+
+func (s *chap7Handler) handleOperatorMessage(op *operator, payload []byte) error {
+	m := InOperatorCommand{}
+	if err := json.Unmarshal(payload, &m); err != nil {
+		return s.sendMessage(nil, op.conn, &OutOperatorError{
+			Uri:     "out/error",
+			Code:    errCodeInvalid,
+			Message: err.Error(),
+		})
+	}
+
+	if err := s.runOperatorCommand(op, &m); err != nil {
+		log.Printf("Operator command `%s` failed: %s", m.Uri, err.Error())
+		return s.sendMessage(nil, op.conn, &OutOperatorError{
+			Uri:       "out/error",
+			RequestID: m.RequestID,
+			Code:      operatorErrorCode(err),
+			Message:   err.Error(),
+		})
+	}
+
+	log.Printf("Operator command `%s` on room `%s`", m.Uri, m.RoomID)
+
+	return s.sendMessage(nil, op.conn, &OutOperatorAck{
+		Uri:       "out/ack",
+		RequestID: m.RequestID,
+		Command:   m.Uri,
+	})
+}
+
 func (s *chap7Handler) handleOperatorDisconnection(conn *websocket.Conn, dchan chan struct{}) {
 	dchan <- struct{}{}
 }
@@ -31,6 +308,9 @@ func (s *chap7Handler) handleOperatorConnection(conn *websocket.Conn) {
 	}(messageChan, disconnectChan)
 
 	roomFactoryEvents := s.roomFactory.subscribe(conn)
+	defer s.roomFactory.unsubscribe(conn, roomFactoryEvents)
+
+	op := &operator{conn: conn, events: roomFactoryEvents}
 
 	// send current list of rooms
 	s.sendMessage(nil, conn, s.roomFactory.listRooms())
@@ -38,11 +318,14 @@ func (s *chap7Handler) handleOperatorConnection(conn *websocket.Conn) {
 	for {
 		select {
 		case payload := <-messageChan:
-			log.Println(string(payload))
-		case <-roomFactoryEvents.roomCreated:
-			s.sendMessage(nil, conn, s.roomFactory.listRooms())
-		case <-roomFactoryEvents.roomDeleted:
-			s.sendMessage(nil, conn, s.roomFactory.listRooms())
+			s.handleOperatorMessage(op, payload)
+		case <-roomFactoryEvents.ready:
+			for _, event := range roomFactoryEvents.pop() {
+				if _, ok := event.(roomsChanged); ok {
+					event = s.roomFactory.listRooms()
+				}
+				s.sendMessage(nil, conn, event)
+			}
 		case <-disconnectChan:
 			return
 		}
@@ -51,6 +334,11 @@ func (s *chap7Handler) handleOperatorConnection(conn *websocket.Conn) {
 }
 
 func (s *chap7Handler) OperatorWS(w http.ResponseWriter, r *http.Request) {
+	if !s.isOperator(r) {
+		responses.Send(w, http.StatusUnauthorized, responses.NewError("unauthorized"))
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Print("upgrade:", err)
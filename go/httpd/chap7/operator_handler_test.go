@@ -0,0 +1,229 @@
+package chap7
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andrefsp/video-democry/go/config"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestHandler returns a handler whose peer connections only gather
+// host candidates.
+func newTestHandler() *chap7Handler {
+	return New(&config.Config{
+		MaxRoomSize: 2,
+	})
+}
+
+// newWatchingOperator returns an operator watching the room, the way
+// handleOperatorConnection sets it up.
+func newWatchingOperator(s *chap7Handler, r *room) *operator {
+	conn := &websocket.Conn{}
+	op := &operator{conn: conn, events: s.roomFactory.subscribe(conn)}
+	op.events.watch(r.ID, true)
+	return op
+}
+
+// runCommand runs the operator command, failing if it does not return.
+func runCommand(t *testing.T, s *chap7Handler, op *operator, m *InOperatorCommand) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- s.runOperatorCommand(op, m)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(3 * time.Second):
+		t.Fatalf("`%s` did not return", m.Uri)
+		return nil
+	}
+}
+
+// waitForEvent returns the first room event with the given uri, dropping
+// the events before it. It fails if none is queued in time.
+func waitForEvent(t *testing.T, events *eventSubscription, uri string) *OutOperatorRoomEvent {
+	timeout := time.After(3 * time.Second)
+	for {
+		queued := events.pop()
+		for i, event := range queued {
+			if m, ok := event.(*OutOperatorRoomEvent); ok && m.Uri == uri {
+				// Keep the rest for the next wait.
+				events.eventsMutex.Lock()
+				events.events = append(append([]interface{}{}, queued[i+1:]...), events.events...)
+				events.eventsMutex.Unlock()
+				return m
+			}
+		}
+
+		select {
+		case <-events.ready:
+		case <-timeout:
+			t.Fatalf("No `%s` event", uri)
+			return nil
+		}
+	}
+}
+
+func TestOperator_kickUserFromWatchedRoom(t *testing.T) {
+	s := newTestHandler()
+	r := s.roomFactory.getOrCreate("room", roomSettings{})
+	op := newWatchingOperator(s, r)
+
+	// Ingest users have no websocket to write to.
+	u := &user{ID: "a", ingest: true}
+	_, err := r.addUser(&websocket.Conn{}, u)
+	assert.Nil(t, err)
+
+	err = runCommand(t, s, op, &InOperatorCommand{Uri: "in/kick", RoomID: r.ID, UserID: u.ID})
+	assert.Nil(t, err)
+	assert.Nil(t, s.roomFactory.get(r.ID))
+
+	assert.Equal(t, u.ID, waitForEvent(t, op.events, "out/user-left").UserID)
+}
+
+// newTestConn returns the server end of a websocket whose client discards
+// every message.
+func newTestConn(t *testing.T) *websocket.Conn {
+	conn, client := newTestConnPair(t)
+	go func() {
+		for {
+			if _, _, err := client.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	return conn
+}
+
+// newTestConnPair returns the server and the client ends of a websocket.
+func newTestConnPair(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+	conns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns <- conn
+	}))
+	t.Cleanup(srv.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	return <-conns, client
+}
+
+func TestOperator_admitUserToWatchedRoom(t *testing.T) {
+	s := newTestHandler()
+	r := s.roomFactory.getOrCreate("room", roomSettings{lobby: true})
+	op := newWatchingOperator(s, r)
+
+	conn := newTestConn(t)
+	assert.Nil(t, s.enterLobby(r, conn, "guest", rolePublisher, ""))
+	lobbyID := r.getLobby()[0].ID
+
+	err := runCommand(t, s, op, &InOperatorCommand{Uri: "in/admit", RoomID: r.ID, LobbyID: lobbyID})
+	assert.Nil(t, err)
+	assert.NotNil(t, r.getUser(conn))
+
+	for _, uri := range []string{"out/lobby-request", "out/lobby-admitted", "out/user-joined"} {
+		waitForEvent(t, op.events, uri)
+	}
+
+	s.handleRoomDisconnection(r, conn)
+}
+
+func TestOperator_promoteDemotePromote(t *testing.T) {
+	s := newTestHandler()
+	r := s.roomFactory.getOrCreate("room", roomSettings{webinar: true})
+	op := newWatchingOperator(s, r)
+
+	u := &user{ID: "a", Role: rolePublisher, subscribers: map[string]*subscriberRTPSenders{}}
+	_, err := r.addUser(newTestConn(t), u)
+	assert.Nil(t, err)
+	assert.False(t, u.canPublish())
+
+	for _, step := range []struct {
+		uri     string
+		onStage bool
+	}{
+		{"in/promote", true},
+		{"in/demote", false},
+		{"in/promote", true},
+	} {
+		err := runCommand(t, s, op, &InOperatorCommand{Uri: step.uri, RoomID: r.ID, UserID: u.ID})
+		assert.Nil(t, err)
+		assert.Equal(t, step.onStage, u.canPublish())
+		assert.Equal(t, step.onStage, len(r.speakerOrder) == 1)
+	}
+
+	for _, uri := range []string{"out/promoted", "out/demoted", "out/promoted"} {
+		waitForEvent(t, op.events, uri)
+	}
+}
+
+func TestOperator_endpointsNeedSecret(t *testing.T) {
+	s := New(&config.Config{TokenSecret: "tokens", OperatorSecret: "secret"})
+
+	for _, handler := range []http.HandlerFunc{s.RoomStats, s.OperatorWS} {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, "/stats?room=room", nil))
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+		// Neither from the query string, nor the token secret.
+		w = httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, "/stats?room=room&token=secret", nil))
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+		w = httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/stats?room=room", nil)
+		req.Header.Set("Authorization", "Bearer tokens")
+		handler(w, req)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/stats?room=room", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	s.RoomStats(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// Rooms needing tokens are not left open to operators.
+	s = New(&config.Config{TokenSecret: "tokens"})
+	w = httptest.NewRecorder()
+	s.RoomStats(w, httptest.NewRequest(http.MethodGet, "/stats?room=room", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestOperator_closeRoomDeniesLobby(t *testing.T) {
+	s := newTestHandler()
+	r := s.roomFactory.getOrCreate("room", roomSettings{lobby: true})
+	op := newWatchingOperator(s, r)
+
+	_, err := r.addUser(&websocket.Conn{}, &user{ID: "a", ingest: true})
+	assert.Nil(t, err)
+
+	conn, client := newTestConnPair(t)
+	assert.Nil(t, s.enterLobby(r, conn, "guest", rolePublisher, ""))
+
+	err = runCommand(t, s, op, &InOperatorCommand{Uri: "in/close", RoomID: r.ID})
+	assert.Nil(t, err)
+	assert.Len(t, r.getLobby(), 0)
+	assert.Nil(t, s.roomFactory.get(r.ID))
+	waitForEvent(t, op.events, "out/lobby-denied")
+
+	for _, uri := range []string{"out/lobby-waiting", "out/lobby-denied"} {
+		m := InfoMessage{}
+		assert.Nil(t, client.ReadJSON(&m))
+		assert.Equal(t, uri, m.Uri)
+	}
+}
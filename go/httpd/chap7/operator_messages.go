@@ -1 +1,79 @@
 package chap7
+
+import "time"
+
+// Commands sent by operators. Each command is answered with an `out/ack`
+// or an `out/error` carrying its request id.
+type InOperatorCommand struct {
+	Uri       string `json:"uri"`
+	RequestID string `json:"requestID"`
+	RoomID    string `json:"roomID"`
+	UserID    string `json:"userID"`
+	Kind      string `json:"kind"`
+	Capacity  int    `json:"capacity"`
+	LobbyID   string `json:"lobbyID"`
+}
+
+type OutOperatorAck struct {
+	Uri       string `json:"uri"`
+	RequestID string `json:"requestID"`
+	Command   string `json:"command"`
+}
+
+type OutOperatorError struct {
+	Uri       string `json:"uri"`
+	RequestID string `json:"requestID"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+}
+
+type trackDetail struct {
+	Kind     string `json:"kind"`
+	Codec    string `json:"codec"`
+	Layer    string `json:"layer,omitempty"`
+	StreamID string `json:"streamID"`
+}
+
+type participantDetail struct {
+	ID          string         `json:"id"`
+	Username    string         `json:"username"`
+	StreamID    string         `json:"streamID"`
+	JoinedAt    time.Time      `json:"joinedAt"`
+	Tracks      []*trackDetail `json:"tracks"`
+	Subscribers int            `json:"subscribers"`
+	ICEState    string         `json:"iceState"`
+	DTLSState   string         `json:"dtlsState"`
+	// Set for the audience of webinar rooms.
+	Audience bool `json:"audience,omitempty"`
+}
+
+type roomDetail struct {
+	ID           string               `json:"id"`
+	Capacity     int                  `json:"capacity"`
+	Locked       bool                 `json:"locked"`
+	Participants []*participantDetail `json:"participants"`
+	Lobby        []*lobbyRequest      `json:"lobby"`
+	Viewers      int                  `json:"viewers"`
+}
+
+type OutRoomDetail struct {
+	Uri       string      `json:"uri"`
+	RequestID string      `json:"requestID"`
+	Room      *roomDetail `json:"room"`
+}
+
+type OutStats struct {
+	Uri       string     `json:"uri"`
+	RequestID string     `json:"requestID"`
+	Stats     *roomStats `json:"stats"`
+}
+
+// Incremental events of the rooms watched by an operator.
+type OutOperatorRoomEvent struct {
+	Uri         string             `json:"uri"`
+	RoomID      string             `json:"roomID"`
+	UserID      string             `json:"userID"`
+	Participant *participantDetail `json:"participant,omitempty"`
+	Track       *trackDetail       `json:"track,omitempty"`
+	Lobby       *lobbyRequest      `json:"lobby,omitempty"`
+}
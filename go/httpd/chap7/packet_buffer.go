@@ -0,0 +1,26 @@
+package chap7
+
+import "github.com/pion/rtp"
+
+// Number of packets kept for retransmission. About a second of HD video.
+const packetBufferSize = 512
+
+// packetBuffer is a ring buffer of the last packets sent on a track,
+// indexed by sequence number. It is not safe for concurrent use.
+type packetBuffer struct {
+	packets [packetBufferSize]*rtp.Packet
+}
+
+func (b *packetBuffer) push(packet *rtp.Packet) {
+	b.packets[packet.SequenceNumber%packetBufferSize] = packet
+}
+
+// get returns the packet with the sequence number or nil if it is no
+// longer in the buffer.
+func (b *packetBuffer) get(sequenceNumber uint16) *rtp.Packet {
+	packet := b.packets[sequenceNumber%packetBufferSize]
+	if packet == nil || packet.SequenceNumber != sequenceNumber {
+		return nil
+	}
+	return packet
+}
@@ -0,0 +1,30 @@
+package chap7
+
+import (
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPacketBuffer_get(t *testing.T) {
+	b := &packetBuffer{}
+
+	for i := 0; i < 10; i++ {
+		b.push(&rtp.Packet{Header: rtp.Header{SequenceNumber: uint16(65530 + i)}})
+	}
+
+	assert.Equal(t, uint16(65535), b.get(65535).SequenceNumber)
+	assert.Equal(t, uint16(3), b.get(3).SequenceNumber)
+	assert.Nil(t, b.get(4))
+}
+
+func TestPacketBuffer_getOverwritten(t *testing.T) {
+	b := &packetBuffer{}
+
+	b.push(&rtp.Packet{Header: rtp.Header{SequenceNumber: 1}})
+	b.push(&rtp.Packet{Header: rtp.Header{SequenceNumber: 1 + packetBufferSize}})
+
+	assert.Nil(t, b.get(1))
+	assert.NotNil(t, b.get(1+packetBufferSize))
+}
@@ -0,0 +1,485 @@
+package chap7
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	recordingManifestFile = "manifest.json"
+
+	// Number of packets the jitter buffer holds before giving up on a gap.
+	audioJitterBufferSize = 25
+	videoJitterBufferSize = 200
+)
+
+type recordingParticipant struct {
+	UserID   string `json:"userID"`
+	Username string `json:"username"`
+
+	// Offsets from the start of the recording.
+	JoinOffset  int64  `json:"joinOffsetMs"`
+	LeaveOffset *int64 `json:"leaveOffsetMs"`
+
+	// A new file is started when a track shows up once the previous one
+	// is written. Each file starts at the offset at the same index.
+	Files       []string `json:"files"`
+	FileOffsets []int64  `json:"fileOffsetsMs"`
+}
+
+type recordingManifest struct {
+	RoomID       string                  `json:"roomID"`
+	StartedAt    time.Time               `json:"startedAt"`
+	Participants []*recordingParticipant `json:"participants"`
+}
+
+// roomRecorder records every publisher of a room to its own directory.
+type roomRecorder struct {
+	dir       string
+	startedAt time.Time
+
+	mutex    sync.Mutex
+	manifest recordingManifest
+	users    map[*user]*userRecorder
+}
+
+func (r *roomRecorder) offset() int64 {
+	return time.Since(r.startedAt).Milliseconds()
+}
+
+// writeManifest must be called with the mutex held. The manifest is
+// rewritten on every change so it survives a crash.
+func (r *roomRecorder) writeManifest() {
+	jData, err := json.MarshalIndent(r.manifest, "", "  ")
+	if err != nil {
+		log.Printf("Error: %s\n", err.Error())
+		return
+	}
+
+	if err := ioutil.WriteFile(path.Join(r.dir, recordingManifestFile), jData, 0644); err != nil {
+		log.Printf("Error writing recording manifest: %s\n", err.Error())
+	}
+}
+
+func (r *roomRecorder) addUser(u *user) *userRecorder {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	participant := &recordingParticipant{
+		UserID:      u.ID,
+		Username:    u.Username,
+		JoinOffset:  r.offset(),
+		Files:       []string{},
+		FileOffsets: []int64{},
+	}
+	r.manifest.Participants = append(r.manifest.Participants, participant)
+	r.writeManifest()
+
+	ur := &userRecorder{
+		room:        r,
+		participant: participant,
+		prefix:      fmt.Sprintf("%s-%d", u.ID, participant.JoinOffset),
+		startedAt:   time.Now(),
+	}
+	r.users[u] = ur
+
+	return ur
+}
+
+func (r *roomRecorder) removeUser(u *user) {
+	r.mutex.Lock()
+	ur, ok := r.users[u]
+	delete(r.users, u)
+	r.mutex.Unlock()
+
+	if !ok {
+		return
+	}
+	ur.close()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	leaveOffset := r.offset()
+	ur.participant.LeaveOffset = &leaveOffset
+	r.writeManifest()
+}
+
+func (r *roomRecorder) addFile(participant *recordingParticipant, fileName string, offset int64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	participant.Files = append(participant.Files, fileName)
+	participant.FileOffsets = append(participant.FileOffsets, offset)
+	r.writeManifest()
+}
+
+func (r *roomRecorder) close() {
+	r.mutex.Lock()
+	users := []*user{}
+	for u := range r.users {
+		users = append(users, u)
+	}
+	r.mutex.Unlock()
+
+	for _, u := range users {
+		r.removeUser(u)
+	}
+	log.Printf("Recording `%s` closed", r.dir)
+}
+
+func newRoomRecorder(baseDir, roomID string) (*roomRecorder, error) {
+	startedAt := time.Now()
+
+	dir := path.Join(baseDir, fmt.Sprintf("%s-%d", roomID, startedAt.Unix()))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	r := &roomRecorder{
+		dir:       dir,
+		startedAt: startedAt,
+		manifest: recordingManifest{
+			RoomID:       roomID,
+			StartedAt:    startedAt,
+			Participants: []*recordingParticipant{},
+		},
+		users: map[*user]*userRecorder{},
+	}
+	r.writeManifest()
+
+	log.Printf("Recording room `%s` to `%s`", roomID, dir)
+
+	return r, nil
+}
+
+// userRecorder records the tracks of a single publisher to a WebM file,
+// split when a track starts after the file header is written.
+type userRecorder struct {
+	room        *roomRecorder
+	participant *recordingParticipant
+	prefix      string
+	startedAt   time.Time
+
+	mutex  sync.Mutex
+	closed bool
+	writer *webmWriter
+	audio  *trackRecorder
+	video  *trackRecorder
+
+	// Number of files written and when (ms since `startedAt`) the current
+	// one starts.
+	files     int
+	fileStart int64
+
+	// Simulcast layer being recorded. The highest layer is picked until
+	// the recording of the video starts.
+	videoLayer       string
+	videoLayerLocked bool
+}
+
+func layerRank(layer string) int {
+	for i, l := range simulcastLayers {
+		if l == layer {
+			return i
+		}
+	}
+	return -1
+}
+
+// addVideoLayer lets the recorder know of a new video layer.
+func (ur *userRecorder) addVideoLayer(layer string) {
+	ur.mutex.Lock()
+	defer ur.mutex.Unlock()
+
+	if ur.videoLayerLocked || layerRank(layer) <= layerRank(ur.videoLayer) {
+		return
+	}
+
+	// Nothing was written from the old layer yet, start over.
+	ur.videoLayer = layer
+	ur.video = nil
+}
+
+// writeRTP records a packet of the given track. The file is created with
+// the first packet so users who never publish have no recording.
+func (ur *userRecorder) writeRTP(kind, layer, mimeType string, packet *rtp.Packet) {
+	ur.mutex.Lock()
+	defer ur.mutex.Unlock()
+
+	if ur.closed || (kind == "video" && layer != ur.videoLayer) {
+		return
+	}
+
+	if ur.writer == nil {
+		if err := ur.openFile(); err != nil {
+			log.Printf("Error recording `%s`: %s\n", ur.participant.UserID, err.Error())
+			ur.closed = true
+			return
+		}
+	}
+
+	track := ur.audio
+	if kind == "video" {
+		track = ur.video
+	}
+
+	if track == nil {
+		track = newTrackRecorder(ur, kind, mimeType)
+		if kind == "video" {
+			ur.video = track
+		} else {
+			ur.audio = track
+		}
+	}
+
+	track.writeRTP(packet)
+
+	if kind == "video" && track.seenKeyframe {
+		ur.videoLayerLocked = true
+	}
+}
+
+// openFile starts a new file. The first one starts when the user joined,
+// the next ones when they are opened.
+func (ur *userRecorder) openFile() error {
+	fileName := fmt.Sprintf("%s.webm", ur.prefix)
+	if ur.files > 0 {
+		fileName = fmt.Sprintf("%s-%d.webm", ur.prefix, ur.files+1)
+		ur.fileStart = time.Since(ur.startedAt).Milliseconds()
+	}
+
+	writer, err := newWebMWriter(path.Join(ur.room.dir, fileName))
+	if err != nil {
+		return err
+	}
+	ur.writer = writer
+	ur.files++
+	ur.room.addFile(ur.participant, fileName, ur.participant.JoinOffset+ur.fileStart)
+	return nil
+}
+
+// splitFile closes the current file for a track it can not take anymore
+// and opens the next one, where every track is declared again.
+func (ur *userRecorder) splitFile() error {
+	if err := ur.writer.close(); err != nil {
+		log.Printf("Error: %s\n", err.Error())
+	}
+	for _, track := range []*trackRecorder{ur.audio, ur.video} {
+		if track != nil {
+			track.declared = false
+		}
+	}
+
+	log.Printf("Recording of `%s` continues in a new file", ur.participant.UserID)
+
+	return ur.openFile()
+}
+
+// declareTrack adds the track to the current file, or to a new one if the
+// header of the current file is written already.
+func (ur *userRecorder) declareTrack(track *webmTrack) bool {
+	if ur.writer.addTrack(track) {
+		return true
+	}
+	if err := ur.splitFile(); err != nil {
+		log.Printf("Error recording `%s`: %s\n", ur.participant.UserID, err.Error())
+		ur.closed = true
+		ur.writer = nil
+		return false
+	}
+	return ur.writer.addTrack(track)
+}
+
+func (ur *userRecorder) close() {
+	ur.mutex.Lock()
+	defer ur.mutex.Unlock()
+
+	ur.closed = true
+	for _, track := range []*trackRecorder{ur.audio, ur.video} {
+		if track != nil {
+			track.close()
+		}
+	}
+
+	if ur.writer != nil {
+		if err := ur.writer.close(); err != nil {
+			log.Printf("Error: %s\n", err.Error())
+		}
+		ur.writer = nil
+	}
+}
+
+// trackRecorder rebuilds the frames of a track from its packets, once
+// they are back in order, and writes them to the user file.
+// Video is only written from the first keyframe.
+type trackRecorder struct {
+	user     *userRecorder
+	kind     string
+	mimeType string
+	codecID  string
+	jitter   *jitterBuffer
+
+	seenKeyframe bool
+	declared     bool
+
+	// Frame being rebuilt. Frames missing packets are dropped.
+	frame          []byte
+	frameTimestamp uint32
+	frameKeyframe  bool
+	frameBroken    bool
+	lastSeq        uint16
+	hasLastSeq     bool
+
+	// The RTP clock is anchored to the time the first packet was written.
+	clockRate      int64
+	offset         int64
+	firstTimestamp int64
+	lastTimestamp  uint32
+	timestamp      int64
+	clockStarted   bool
+}
+
+func (t *trackRecorder) writeRTP(packet *rtp.Packet) {
+	if t.jitter == nil {
+		return
+	}
+
+	for _, p := range t.jitter.push(packet) {
+		t.write(p)
+	}
+}
+
+func (t *trackRecorder) write(packet *rtp.Packet) {
+	if t.hasLastSeq && packet.SequenceNumber != t.lastSeq+1 {
+		t.frameBroken = true
+	}
+	t.lastSeq = packet.SequenceNumber
+	t.hasLastSeq = true
+
+	if t.kind == "audio" {
+		// Each Opus packet is a whole frame.
+		if !t.declared {
+			t.declared = t.user.declareTrack(&webmTrack{kind: t.kind, codecID: t.codecID, channels: 2})
+		}
+		t.writeFrame(packet.Timestamp, true, packet.Payload)
+		return
+	}
+
+	if !t.seenKeyframe {
+		if !isKeyframe(t.mimeType, packet.Payload) {
+			return
+		}
+		t.seenKeyframe = true
+	}
+
+	payload, start, err := depacketize(t.mimeType, packet.Payload)
+	if err != nil {
+		return
+	}
+
+	if start {
+		// Anything left of the previous frame is incomplete.
+		t.frame = []byte{}
+		t.frameTimestamp = packet.Timestamp
+		t.frameKeyframe = isKeyframe(t.mimeType, packet.Payload)
+		t.frameBroken = false
+	} else if t.frame == nil || packet.Timestamp != t.frameTimestamp {
+		// The start of this frame is missing.
+		t.frame = nil
+		return
+	}
+	t.frame = append(t.frame, payload...)
+
+	if !packet.Marker {
+		return
+	}
+
+	frame := t.frame
+	t.frame = nil
+	if t.frameBroken {
+		return
+	}
+
+	if t.frameKeyframe && !t.declared {
+		if width, height, ok := frameSize(t.mimeType, frame); ok {
+			t.declared = t.user.declareTrack(&webmTrack{kind: t.kind, codecID: t.codecID, width: width, height: height})
+		}
+	}
+	t.writeFrame(t.frameTimestamp, t.frameKeyframe, frame)
+}
+
+// writeFrame writes a frame with its RTP timestamp turned into
+// milliseconds since the start of the file.
+func (t *trackRecorder) writeFrame(timestamp uint32, keyframe bool, frame []byte) {
+	if !t.clockStarted {
+		t.clockStarted = true
+		t.offset = time.Since(t.user.startedAt).Milliseconds()
+		t.firstTimestamp = int64(timestamp)
+		t.timestamp = int64(timestamp)
+		t.lastTimestamp = timestamp
+	}
+	t.timestamp += int64(int32(timestamp - t.lastTimestamp))
+	t.lastTimestamp = timestamp
+
+	if t.user.writer == nil {
+		return
+	}
+
+	ms := t.offset + (t.timestamp-t.firstTimestamp)*1000/t.clockRate - t.user.fileStart
+	if ms < 0 {
+		ms = 0
+	}
+
+	if err := t.user.writer.writeFrame(t.kind, ms, keyframe, frame); err != nil {
+		log.Printf("Error recording frame: %s\n", err.Error())
+	}
+}
+
+func (t *trackRecorder) close() {
+	if t.jitter == nil {
+		return
+	}
+
+	for _, p := range t.jitter.flush() {
+		t.write(p)
+	}
+	t.jitter = nil
+}
+
+func newTrackRecorder(ur *userRecorder, kind, mimeType string) *trackRecorder {
+	t := &trackRecorder{
+		user:      ur,
+		kind:      kind,
+		mimeType:  mimeType,
+		clockRate: 90000,
+	}
+
+	switch strings.ToLower(mimeType) {
+	case mimeTypeOpus:
+		t.codecID = "A_OPUS"
+		t.clockRate = 48000
+		t.jitter = newJitterBuffer(audioJitterBufferSize)
+	case mimeTypeVP8:
+		t.codecID = "V_VP8"
+		t.jitter = newJitterBuffer(videoJitterBufferSize)
+	case mimeTypeVP9:
+		t.codecID = "V_VP9"
+		t.jitter = newJitterBuffer(videoJitterBufferSize)
+	default:
+		// WebM only carries VP8/VP9 and Opus. Leaving the jitter buffer
+		// unset drops every packet of the track.
+		log.Printf("Error recording %s of `%s`: codec `%s` not supported\n", kind, ur.participant.UserID, mimeType)
+	}
+
+	return t
+}
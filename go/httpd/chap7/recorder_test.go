@@ -0,0 +1,61 @@
+package chap7
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecorder_videoAfterHeaderStartsNewFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recording")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	r, err := newRoomRecorder(dir, "room")
+	assert.Nil(t, err)
+
+	u := &user{ID: "user", Username: "alice"}
+	ur := r.addUser(u)
+
+	audio := func(seq uint16) {
+		ur.writeRTP("audio", "", mimeTypeOpus, &rtp.Packet{
+			Header:  rtp.Header{SequenceNumber: seq, Timestamp: uint32(seq) * 960},
+			Payload: []byte{0xfc, byte(seq)},
+		})
+	}
+
+	// 4s of audio, the header is written with the audio track only.
+	for seq := uint16(0); seq < 200; seq++ {
+		audio(seq)
+	}
+
+	// A 640x480 VP8 keyframe.
+	ur.writeRTP("video", "", mimeTypeVP8, &rtp.Packet{
+		Header:  rtp.Header{SequenceNumber: 0, Timestamp: 0, Marker: true},
+		Payload: []byte{0x10, 0x10, 0x02, 0x00, 0x9d, 0x01, 0x2a, 0x80, 0x02, 0xe0, 0x01, 0x00},
+	})
+	audio(200)
+
+	r.close()
+
+	participant := r.manifest.Participants[0]
+	assert.Equal(t, []string{ur.prefix + ".webm", ur.prefix + "-2.webm"}, participant.Files)
+	assert.Equal(t, 2, len(participant.FileOffsets))
+	assert.Equal(t, participant.JoinOffset, participant.FileOffsets[0])
+	assert.True(t, participant.FileOffsets[1] >= participant.FileOffsets[0])
+
+	first, err := ioutil.ReadFile(path.Join(r.dir, participant.Files[0]))
+	assert.Nil(t, err)
+	assert.True(t, bytes.Contains(first, []byte("OpusHead")))
+	assert.False(t, bytes.Contains(first, []byte("V_VP8")))
+
+	second, err := ioutil.ReadFile(path.Join(r.dir, participant.Files[1]))
+	assert.Nil(t, err)
+	assert.True(t, bytes.Contains(second, []byte("V_VP8")))
+	assert.True(t, bytes.Contains(second, []byte("OpusHead")))
+}
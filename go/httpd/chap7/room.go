@@ -1,17 +1,28 @@
 package chap7
 
 import (
+	"crypto/subtle"
 	"errors"
+	"fmt"
 	"log"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-const MaxRoomSize = 2
+var (
+	ErrMaxUsersPerRoom = errors.New("Maximum users in room")
+	ErrSessionNotFound = errors.New("Session not found")
+	ErrRoomLocked      = errors.New("Room is locked")
+	ErrInvalidCapacity = errors.New("Capacity must be a positive integer")
+	ErrStreamIDInUse   = errors.New("Stream ID already in use in the room")
+	ErrRoomClosed      = errors.New("Room is closed")
+)
 
-var ErrMaxUsersPerRoom = errors.New("Maximum users in room")
+// Name given to users joining without one.
+const defaultUsername = "guest"
 
 type room struct {
 	ID           string `json:"id"`
@@ -19,41 +30,186 @@ type room struct {
 
 	usersMutex sync.RWMutex
 	users      map[*websocket.Conn]*user
+	capacity   int
+	// Locked rooms do not take new users.
+	locked bool
+	// Set once the room is empty and deleted, with both `usersMutex` and
+	// `lobbyMutex` held. Nobody joins a closed room, a new one is created.
+	closed bool
+
+	// Users joining a room with the lobby enabled wait there until they
+	// are let in. Moderators go straight in.
+	lobbyEnabled bool
+	lobbyMutex   sync.Mutex
+	lobby        map[string]*lobbyRequest
+
+	// Webinar rooms have a stage of publishers and an audience which only
+	// subscribes. Moderators join on the stage.
+	webinar bool
+
+	// Last room-wide chat messages, the oldest first.
+	chatMutex   sync.Mutex
+	chatHistory []*chatMessage
+
+	// WHEP viewers, by id.
+	viewersMutex sync.Mutex
+	viewers      map[string]*viewer
+
+	// Set when the room is being recorded.
+	recorder *roomRecorder
+
+	speakers *activeSpeakerDetector
+
+	// Number of users, by speaker activity, whose video is forwarded to
+	// each subscriber. Zero forwards every video.
+	lastN int
+	// User ids, the most recent speakers first.
+	speakerOrderMutex sync.Mutex
+	speakerOrder      []string
+
+	// Called from the room goroutine when the active speaker changes.
+	onActiveSpeaker func(r *room, speaker *user)
 
 	ticker   <-chan time.Time
 	stopChan chan struct{}
 }
 
-func (r *room) handleStreamSubscriptions() error {
-	for _, publisher := range r.getUserList() {
-		for _, subscriber := range r.getUserList() {
+// handleStreamSubscriptions subscribes `u` to every other user in the room
+// and every other user to `u`. Only the pairs involving `u` are visited so
+// the cost of a join or a new track is linear on the room size. Audience
+// members have nothing to exchange with each other.
+func (r *room) handleStreamSubscriptions(u *user) {
+	for _, other := range r.getUserList() {
+		if other.ID == u.ID {
+			continue
+		}
+		if !u.canPublish() && !other.canPublish() {
+			continue
+		}
+
+		if err := u.addSubscriber(other); err != nil {
+			log.Print("Error: ", err.Error())
+		}
+		if err := other.addSubscriber(u); err != nil {
+			log.Print("Error: ", err.Error())
+		}
+	}
+
+	r.updateLastN()
+}
+
+// promoteSpeaker moves the user to the front of the speaker order.
+func (r *room) promoteSpeaker(id string) {
+	r.speakerOrderMutex.Lock()
+	defer r.speakerOrderMutex.Unlock()
+
+	order := []string{id}
+	for _, other := range r.speakerOrder {
+		if other != id {
+			order = append(order, other)
+		}
+	}
+	r.speakerOrder = order
+}
+
+func (r *room) removeSpeaker(id string) {
+	r.speakerOrderMutex.Lock()
+	defer r.speakerOrderMutex.Unlock()
+
+	order := []string{}
+	for _, other := range r.speakerOrder {
+		if other != id {
+			order = append(order, other)
+		}
+	}
+	r.speakerOrder = order
+}
+
+// forwardedVideo returns the ids of the users whose video is forwarded to
+// the subscriber: the last N speakers other than the subscriber and the
+// users it pinned.
+func (r *room) forwardedVideo(subscriber *user) map[string]bool {
+	r.speakerOrderMutex.Lock()
+	defer r.speakerOrderMutex.Unlock()
+
+	forwarded := map[string]bool{}
+	for _, id := range r.speakerOrder {
+		if id == subscriber.ID {
+			continue
+		}
+		if r.lastN > 0 && len(forwarded) >= r.lastN && !subscriber.isPinned(id) {
+			continue
+		}
+		forwarded[id] = true
+	}
+	return forwarded
+}
+
+// updateLastN pauses the video of the users out of the Last-N of each
+// subscriber and resumes the rest.
+func (r *room) updateLastN() {
+	users := r.getUserList()
+
+	publishers := []*user{}
+	for _, publisher := range users {
+		if publisher.canPublish() {
+			publishers = append(publishers, publisher)
+		}
+	}
+
+	for _, subscriber := range users {
+		forwarded := r.forwardedVideo(subscriber)
+		for _, publisher := range publishers {
 			if publisher.ID == subscriber.ID {
 				continue
 			}
-
-			if err := publisher.addSubscriber(subscriber); err != nil {
-				log.Print("Error: ", err.Error())
-				return err
-			}
+			publisher.setSubscriberPaused(subscriber, !forwarded[publisher.ID])
 		}
 	}
-	return nil
 }
 
 func (r *room) stop() {
 	r.stopChan <- struct{}{}
+
+	for _, v := range r.getViewers() {
+		r.removeViewer(v.ID)
+		v.close()
+	}
+
+	if r.recorder != nil {
+		r.recorder.close()
+	}
 }
 
 func (r *room) start() {
 	go func() {
+		speakerTicker := time.NewTicker(activeSpeakerInterval)
+		defer speakerTicker.Stop()
+
 		for {
 			select {
+			case <-speakerTicker.C:
+				speakerID, changed := r.speakers.detect()
+				if !changed {
+					continue
+				}
+				speaker := r.getUserByID(speakerID)
+				if speaker == nil {
+					continue
+				}
+				r.promoteSpeaker(speaker.ID)
+				r.updateLastN()
+				if r.onActiveSpeaker != nil {
+					r.onActiveSpeaker(r, speaker)
+				}
 			case <-r.ticker:
-				for conn := range r.users {
+				r.messageMutex.Lock()
+				for _, conn := range r.getUserConnections() {
 					conn.WriteMessage(websocket.TextMessage, []byte(`{"uri":"out/ping"}`))
 				}
+				r.messageMutex.Unlock()
 			case <-r.stopChan:
-				break
+				return
 			}
 		}
 	}()
@@ -66,18 +222,134 @@ func (r *room) getUser(conn *websocket.Conn) *user {
 	return r.users[conn]
 }
 
+func (r *room) getUserByID(id string) *user {
+	r.usersMutex.RLock()
+	defer r.usersMutex.RUnlock()
+
+	for _, user := range r.users {
+		if user.ID == id {
+			return user
+		}
+	}
+	return nil
+}
+
+// getUserConn returns the connection of the user with the given id.
+func (r *room) getUserConn(id string) *websocket.Conn {
+	r.usersMutex.RLock()
+	defer r.usersMutex.RUnlock()
+
+	for conn, user := range r.users {
+		if user.ID == id {
+			return conn
+		}
+	}
+	return nil
+}
+
+// getIngestConn returns the connection of the WHIP user with the given
+// resource secret.
+func (r *room) getIngestConn(resource string) *websocket.Conn {
+	r.usersMutex.RLock()
+	defer r.usersMutex.RUnlock()
+
+	for conn, user := range r.users {
+		if user.ingest && subtle.ConstantTimeCompare([]byte(user.resource), []byte(resource)) == 1 {
+			return conn
+		}
+	}
+	return nil
+}
+
+func (r *room) setLocked(locked bool) {
+	r.usersMutex.Lock()
+	defer r.usersMutex.Unlock()
+
+	r.locked = locked
+}
+
+// setCapacity changes the maximum number of users. Users already in the
+// room are kept when the capacity goes below their number.
+func (r *room) setCapacity(capacity int) error {
+	if capacity < 1 {
+		return ErrInvalidCapacity
+	}
+
+	r.usersMutex.Lock()
+	defer r.usersMutex.Unlock()
+
+	r.capacity = capacity
+	return nil
+}
+
 func (r *room) addUser(conn *websocket.Conn, user *user) (*user, error) {
 	r.usersMutex.Lock()
 	defer r.usersMutex.Unlock()
 
-	if len(r.users) >= MaxRoomSize {
+	if r.closed {
+		return nil, ErrRoomClosed
+	}
+
+	if r.locked {
+		return nil, ErrRoomLocked
+	}
+
+	if len(r.users) >= r.capacity {
 		return nil, ErrMaxUsersPerRoom
 	}
 
+	// Subscribers tell publishers apart by their stream.
+	for _, other := range r.users {
+		if user.StreamID != "" && other.StreamID == user.StreamID {
+			return nil, ErrStreamIDInUse
+		}
+	}
+	user.Username = r.uniqueUsername(user.Username)
+
+	if r.recorder != nil {
+		user.recorder = r.recorder.addUser(user)
+	}
+	user.speakers = r.speakers
+	user.joinedAt = time.Now()
+	user.webinar = r.webinar
+	user.onStage = user.ingest || user.Role == roleModerator
+	if !user.ingest {
+		user.setConn(conn)
+	}
+
 	r.users[conn] = user
+
+	// New users are the least recent speakers. The audience of webinars
+	// is left out so it does not take the place of the stage in Last-N.
+	if user.canPublish() {
+		r.speakerOrderMutex.Lock()
+		r.speakerOrder = append(r.speakerOrder, user.ID)
+		r.speakerOrderMutex.Unlock()
+	}
+
 	return user, nil
 }
 
+// uniqueUsername returns `name`, numbered if another user of the room has
+// it already. Must be called with `usersMutex` held.
+func (r *room) uniqueUsername(name string) string {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = defaultUsername
+	}
+
+	taken := map[string]bool{}
+	for _, other := range r.users {
+		taken[strings.ToLower(other.Username)] = true
+	}
+
+	unique := name
+	for i := 2; taken[strings.ToLower(unique)]; i++ {
+		unique = fmt.Sprintf("%s (%d)", name, i)
+	}
+	return unique
+}
+
 func (r *room) removeUser(conn *websocket.Conn) *user {
 	user := r.getUser(conn)
 	if user == nil {
@@ -103,12 +375,87 @@ func (r *room) removeUser(conn *websocket.Conn) *user {
 	user = r.users[conn]
 	user.stop()
 
+	if r.recorder != nil {
+		r.recorder.removeUser(user)
+	}
+	r.speakers.remove(user.ID)
+	r.removeSpeaker(user.ID)
+
 	delete(r.users, conn)
 
 	return user
 }
 
-func (r *room) getUserConnections() []*websocket.Conn {
+func (r *room) getDetail() *roomDetail {
+	r.usersMutex.RLock()
+	detail := &roomDetail{
+		ID:           r.ID,
+		Capacity:     r.capacity,
+		Locked:       r.locked,
+		Participants: []*participantDetail{},
+		Lobby:        r.getLobby(),
+		Viewers:      len(r.getViewers()),
+	}
+	r.usersMutex.RUnlock()
+
+	for _, user := range r.getUserList() {
+		detail.Participants = append(detail.Participants, user.getDetail())
+	}
+	return detail
+}
+
+// isEmpty tells whether there is nobody in the room or its lobby.
+func (r *room) isEmpty() bool {
+	return len(r.getUserList()) < 1 && len(r.getLobby()) < 1
+}
+
+// closeIfEmpty closes the room if there is nobody in it or its lobby. It
+// can not be joined once closed.
+func (r *room) closeIfEmpty() bool {
+	r.usersMutex.Lock()
+	defer r.usersMutex.Unlock()
+	r.lobbyMutex.Lock()
+	defer r.lobbyMutex.Unlock()
+
+	if r.closed || len(r.users) > 0 || len(r.lobby) > 0 {
+		return false
+	}
+	r.closed = true
+	return true
+}
+
+// detachUser keeps the user of a dropped connection in the room so it can
+// resume its session. Nothing is sent to the user while detached.
+func (r *room) detachUser(conn *websocket.Conn) *user {
+	user := r.getUser(conn)
+	if user != nil {
+		user.setConn(nil)
+	}
+	return user
+}
+
+// resumeUser attaches the user with the given resume token to a new
+// connection. The previous connection is returned so it can be closed if
+// still open.
+func (r *room) resumeUser(token string, conn *websocket.Conn) (*user, *websocket.Conn, error) {
+	r.usersMutex.Lock()
+	defer r.usersMutex.Unlock()
+
+	for oldConn, user := range r.users {
+		if token == "" || subtle.ConstantTimeCompare([]byte(user.resumeToken), []byte(token)) != 1 {
+			continue
+		}
+
+		delete(r.users, oldConn)
+		r.users[conn] = user
+		user.setConn(conn)
+		return user, oldConn, nil
+	}
+	return nil, nil, ErrSessionNotFound
+}
+
+// getConnections returns the connections of every user, detached or not.
+func (r *room) getConnections() []*websocket.Conn {
 	r.usersMutex.RLock()
 	defer r.usersMutex.RUnlock()
 
@@ -119,6 +466,21 @@ func (r *room) getUserConnections() []*websocket.Conn {
 	return conns
 }
 
+// getUserConnections returns the connections of the users which are not
+// detached.
+func (r *room) getUserConnections() []*websocket.Conn {
+	r.usersMutex.RLock()
+	defer r.usersMutex.RUnlock()
+
+	conns := []*websocket.Conn{}
+	for conn, user := range r.users {
+		if user.getConn() != nil {
+			conns = append(conns, conn)
+		}
+	}
+	return conns
+}
+
 func (r *room) getUserList() []*user {
 	r.usersMutex.RLock()
 	defer r.usersMutex.RUnlock()
@@ -130,10 +492,15 @@ func (r *room) getUserList() []*user {
 	return users
 }
 
-func newRoom(id string) *room {
+func newRoom(id string, capacity, lastN int) *room {
 	return &room{
 		ID:       id,
 		users:    map[*websocket.Conn]*user{},
+		capacity: capacity,
+		lobby:    map[string]*lobbyRequest{},
+		viewers:  map[string]*viewer{},
+		speakers: newActiveSpeakerDetector(),
+		lastN:    lastN,
 		ticker:   time.NewTicker(15 * time.Second).C,
 		stopChan: make(chan struct{}, 1),
 	}
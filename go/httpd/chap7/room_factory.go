@@ -8,9 +8,82 @@ import (
 	"github.com/gorilla/websocket"
 )
 
+// Events queued for an operator which is not reading them fast enough
+// before it gets disconnected.
+const maxQueuedEvents = 4096
+
+// roomsChanged is queued when a room is created or deleted.
+type roomsChanged struct{}
+
+// eventSubscription queues the room factory events for a subscriber.
+// Queuing never blocks so the rooms do not wait on the subscribers, nor a
+// subscriber on itself when its commands trigger events.
 type eventSubscription struct {
-	roomCreated chan *room
-	roomDeleted chan *room
+	conn *websocket.Conn
+
+	eventsMutex sync.Mutex
+	events      []interface{}
+	overflowed  bool
+	// Signalled when events are queued.
+	ready chan struct{}
+
+	// Rooms whose events are sent to the subscriber.
+	watchedRoomsMutex sync.Mutex
+	watchedRooms      map[string]bool
+}
+
+// push queues the event. A subscriber with a full queue has missed events,
+// it is disconnected so it starts again from the room list.
+func (e *eventSubscription) push(event interface{}) {
+	e.eventsMutex.Lock()
+	defer e.eventsMutex.Unlock()
+
+	if e.overflowed {
+		return
+	}
+	if len(e.events) >= maxQueuedEvents {
+		log.Printf("Dropping events of a slow subscriber, disconnecting it")
+		e.overflowed = true
+		e.events = nil
+		if e.conn != nil {
+			e.conn.Close()
+		}
+		return
+	}
+	e.events = append(e.events, event)
+
+	select {
+	case e.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pop returns the queued events, the oldest first.
+func (e *eventSubscription) pop() []interface{} {
+	e.eventsMutex.Lock()
+	defer e.eventsMutex.Unlock()
+
+	events := e.events
+	e.events = nil
+	return events
+}
+
+func (e *eventSubscription) watch(roomID string, watch bool) {
+	e.watchedRoomsMutex.Lock()
+	defer e.watchedRoomsMutex.Unlock()
+
+	if watch {
+		e.watchedRooms[roomID] = true
+		return
+	}
+	delete(e.watchedRooms, roomID)
+}
+
+func (e *eventSubscription) isWatching(roomID string) bool {
+	e.watchedRoomsMutex.Lock()
+	defer e.watchedRoomsMutex.Unlock()
+
+	return e.watchedRooms[roomID]
 }
 
 // Room factory manages room creations
@@ -22,15 +95,43 @@ type roomFactory struct {
 
 	eventSubscriptionsMutext sync.Mutex
 	eventSubscriptions       map[*websocket.Conn]*eventSubscription
+
+	// Set on every new room.
+	onActiveSpeaker func(r *room, speaker *user)
 }
 
-func (f *roomFactory) notify(r *room, action string) {
+// getSubscriptions returns the subscriptions so events are queued without
+// holding the lock.
+func (f *roomFactory) getSubscriptions() []*eventSubscription {
+	f.eventSubscriptionsMutext.Lock()
+	defer f.eventSubscriptionsMutext.Unlock()
+
+	subscriptions := []*eventSubscription{}
 	for _, subscription := range f.eventSubscriptions {
-		switch action {
-		case "deleted":
-			subscription.roomDeleted <- r
-		case "created":
-			subscription.roomCreated <- r
+		subscriptions = append(subscriptions, subscription)
+	}
+	return subscriptions
+}
+
+// notifyRoomsChanged lets the subscribers know a room was created or
+// deleted.
+func (f *roomFactory) notifyRoomsChanged() {
+	for _, subscription := range f.getSubscriptions() {
+		subscription.push(roomsChanged{})
+	}
+}
+
+func (f *roomFactory) notifyActiveSpeaker(m *OutActiveSpeaker) {
+	for _, subscription := range f.getSubscriptions() {
+		subscription.push(m)
+	}
+}
+
+// notifyRoomEvent sends the event to the subscribers watching the room.
+func (f *roomFactory) notifyRoomEvent(m *OutOperatorRoomEvent) {
+	for _, subscription := range f.getSubscriptions() {
+		if subscription.isWatching(m.RoomID) {
+			subscription.push(m)
 		}
 	}
 }
@@ -40,27 +141,54 @@ func (f *roomFactory) subscribe(conn *websocket.Conn) *eventSubscription {
 	defer f.eventSubscriptionsMutext.Unlock()
 
 	f.eventSubscriptions[conn] = &eventSubscription{
-		roomCreated: make(chan *room),
-		roomDeleted: make(chan *room),
+		conn:         conn,
+		ready:        make(chan struct{}, 1),
+		watchedRooms: map[string]bool{},
 	}
 
 	return f.eventSubscriptions[conn]
 }
 
+func (f *roomFactory) unsubscribe(conn *websocket.Conn, subscription *eventSubscription) {
+	f.eventSubscriptionsMutext.Lock()
+	defer f.eventSubscriptionsMutext.Unlock()
+
+	delete(f.eventSubscriptions, conn)
+}
+
 func (f *roomFactory) deleteIfEmpty(r *room) bool {
 	f.roomsMutex.Lock()
 	defer f.roomsMutex.Unlock()
 
-	if len(r.getUserList()) < 1 {
+	if f.rooms[r.ID] != r {
+		// Already deleted.
+		return false
+	}
+
+	if r.closeIfEmpty() {
+		r.stop()
 		delete(f.rooms, r.ID)
-		defer f.notify(f.rooms[r.ID], "deleted")
+		f.notifyRoomsChanged()
 		return true
 	}
 
 	return false
 }
 
-func (f *roomFactory) getOrCreate(id string) *room {
+// Settings for a new room, taken from the first connection to it.
+type roomSettings struct {
+	// Zero means the server default from the config.
+	capacity int
+	// Zero means the server default.
+	lastN   int
+	record  bool
+	lobby   bool
+	webinar bool
+}
+
+// getOrCreate returns the room with the given id, creating it if needed.
+// `settings` are only used when the room is created.
+func (f *roomFactory) getOrCreate(id string, settings roomSettings) *room {
 	f.roomsMutex.Lock()
 	defer f.roomsMutex.Unlock()
 
@@ -68,12 +196,40 @@ func (f *roomFactory) getOrCreate(id string) *room {
 		return r
 	}
 
-	defer log.Printf("New room created. ID: `%s`", id)
+	capacity := settings.capacity
+	if capacity < 1 {
+		capacity = f.cfg.MaxRoomSize
+	}
+
+	lastN := settings.lastN
+	if lastN == 0 {
+		lastN = f.cfg.LastN
+	}
 
-	f.rooms[id] = newRoom(id)
+	defer log.Printf("New room created. ID: `%s` capacity: %d lastN: %d", id, capacity, lastN)
+
+	f.rooms[id] = newRoom(id, capacity, lastN)
+	f.rooms[id].onActiveSpeaker = f.onActiveSpeaker
+	f.rooms[id].lobbyEnabled = settings.lobby
+	f.rooms[id].webinar = settings.webinar
+
+	if settings.record {
+		recorder, err := newRoomRecorder(f.cfg.RecordingsDir, id)
+		if err != nil {
+			log.Printf("Error: room `%s` will not be recorded: %s", id, err.Error())
+		}
+		f.rooms[id].recorder = recorder
+	}
 	f.rooms[id].start()
 
-	defer f.notify(f.rooms[id], "created")
+	f.notifyRoomsChanged()
+
+	return f.rooms[id]
+}
+
+func (f *roomFactory) get(id string) *room {
+	f.roomsMutex.RLock()
+	defer f.roomsMutex.RUnlock()
 
 	return f.rooms[id]
 }
@@ -0,0 +1,31 @@
+package chap7
+
+import (
+	"testing"
+
+	"github.com/andrefsp/video-democry/go/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoomFactory_notifyDoesNotBlock(t *testing.T) {
+	f := newRoomFactory(&config.Config{MaxRoomSize: 2})
+	subscription := f.subscribe(nil)
+	subscription.watch("room", true)
+
+	// Nobody reads the events.
+	f.notifyActiveSpeaker(&OutActiveSpeaker{RoomID: "room"})
+	f.notifyRoomEvent(&OutOperatorRoomEvent{RoomID: "room"})
+	f.notifyRoomEvent(&OutOperatorRoomEvent{RoomID: "other"})
+	f.notifyRoomsChanged()
+
+	<-subscription.ready
+	events := subscription.pop()
+	assert.Len(t, events, 3)
+	assert.Equal(t, roomsChanged{}, events[2])
+
+	for i := 0; i <= maxQueuedEvents; i++ {
+		f.notifyRoomsChanged()
+	}
+	assert.Len(t, subscription.pop(), 0)
+	assert.True(t, subscription.overflowed)
+}
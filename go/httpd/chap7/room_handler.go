@@ -4,7 +4,10 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/pion/webrtc/v3"
 
 	"github.com/gorilla/websocket"
@@ -24,7 +27,7 @@ func (s *chap7Handler) handleICECandidate(r *room, conn *websocket.Conn, message
 		return nil
 	}
 
-	if err := user.pc.AddICECandidate(cm.Candidate); err != nil {
+	if err := user.addICECandidate(cm.Candidate); err != nil {
 		log.Printf("Error adding ICECandidate(%s): (%+v)\n", err.Error(), cm.Candidate)
 		return err
 	}
@@ -36,32 +39,47 @@ func (s *chap7Handler) handleICECandidate(r *room, conn *websocket.Conn, message
 func (s *chap7Handler) sendAnswer(r *room, conn *websocket.Conn, offer webrtc.SessionDescription) error {
 	user := r.getUser(conn)
 
-	if err := user.pc.SetRemoteDescription(offer); err != nil {
-		log.Print("Error: ", err.Error())
-		return err
-	}
+	return user.negotiation.do(func() error {
+		// pion can not roll back its own offer, so on collision the SFU
+		// keeps it and the user is expected to answer it instead.
+		// Client ICE restart offers are applied by SetRemoteDescription.
+		if user.pc.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+			log.Printf("Offer collision with user `%s`, keeping the SFU offer", user.ID)
+			return s.sendMessage(r, conn, &OutOffer{
+				Uri:    "out/offer",
+				ToUser: user,
+				Offer:  *user.pc.LocalDescription(),
+			})
+		}
 
-	// Answer and respond
-	answer, err := user.pc.CreateAnswer(nil)
-	if err != nil {
-		log.Print("Error: ", err.Error())
-		return err
-	}
+		if err := user.pc.SetRemoteDescription(offer); err != nil {
+			log.Print("Error: ", err.Error())
+			return err
+		}
+		user.flushICECandidates()
 
-	if err := user.pc.SetLocalDescription(answer); err != nil {
-		log.Print("Error: ", err.Error())
-		return err
-	}
+		// Answer and respond
+		answer, err := user.pc.CreateAnswer(nil)
+		if err != nil {
+			log.Print("Error: ", err.Error())
+			return err
+		}
 
-	s.sendMessage(r, conn, &OutAnswer{
-		Uri:    "out/answer",
-		ToUser: user, // We are answering to the same user.
-		Answer: answer,
-	})
+		if err := user.pc.SetLocalDescription(answer); err != nil {
+			log.Print("Error: ", err.Error())
+			return err
+		}
 
-	log.Printf("Answer sent to user %s", user.ID)
+		s.sendMessage(r, conn, &OutAnswer{
+			Uri:    "out/answer",
+			ToUser: user, // We are answering to the same user.
+			Answer: answer,
+		})
 
-	return nil
+		log.Printf("Answer sent to user %s", user.ID)
+
+		return nil
+	})
 }
 
 func (s *chap7Handler) handleAnswer(r *room, conn *websocket.Conn, messagePayload []byte) error {
@@ -73,11 +91,27 @@ func (s *chap7Handler) handleAnswer(r *room, conn *websocket.Conn, messagePayloa
 		return err
 	}
 
-	if err := user.pc.SetRemoteDescription(om.Answer); err != nil {
-		log.Printf("Error: %s\n", err.Error())
-	}
+	restart := false
+	err := user.negotiation.do(func() error {
+		// A late or repeated answer has no offer to apply to.
+		if user.pc.SignalingState() != webrtc.SignalingStateHaveLocalOffer {
+			log.Printf("Ignoring answer from user `%s` in state `%s`", user.ID, user.pc.SignalingState())
+			return nil
+		}
 
-	return nil
+		if err := user.pc.SetRemoteDescription(om.Answer); err != nil {
+			log.Printf("Error: %s\n", err.Error())
+			return err
+		}
+		user.flushICECandidates()
+
+		restart, user.iceRestartPending = user.iceRestartPending, false
+		return nil
+	})
+	if err != nil || !restart {
+		return err
+	}
+	return s.restartICE(r, user)
 }
 
 func (s *chap7Handler) handleOffer(r *room, conn *websocket.Conn, messagePayload []byte) error {
@@ -100,120 +134,526 @@ func (s *chap7Handler) handleOffer(r *room, conn *websocket.Conn, messagePayload
 			return
 		}
 		//log.Printf("Sending ICE candidate to `%s`", user.ID)
-		s.sendMessage(r, conn, &OutICECandidate{
+		s.sendToUser(r, user, &OutICECandidate{
 			Uri:       "out/icecandidate",
 			ToUser:    user,
 			Candidate: c.ToJSON(),
 		})
 	})
 
-	user.pc.OnICEConnectionStateChange(func(s webrtc.ICEConnectionState) {
-		switch s {
+	user.pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		switch state {
 		case webrtc.ICEConnectionStateFailed:
-			fallthrough
+			log.Printf("ICE state `%s` with user `%s`", state.String(), user.ID)
+			go s.restartICE(r, user)
+		case webrtc.ICEConnectionStateDisconnected:
+			log.Printf("ICE state `%s` with user `%s`", state.String(), user.ID)
+			// Disconnected often recovers on its own, restart only if it
+			// does not.
+			time.AfterFunc(iceDisconnectedTimeout, func() {
+				if user.pc.ICEConnectionState() == webrtc.ICEConnectionStateDisconnected {
+					s.restartICE(r, user)
+				}
+			})
 		case webrtc.ICEConnectionStateConnected:
 			fallthrough
 		case webrtc.ICEConnectionStateCompleted:
 			fallthrough
 		case webrtc.ICEConnectionStateClosed:
-			fallthrough
-		case webrtc.ICEConnectionStateDisconnected:
-			log.Printf("ICE state `%s` with user `%s`", s.String(), user.ID)
+			log.Printf("ICE state `%s` with user `%s`", state.String(), user.ID)
 		}
 	})
 
 	user.pc.OnTrack(func(t *webrtc.TrackRemote, rec *webrtc.RTPReceiver) {
-		log.Printf("Received track: `%s` mimetype: `%s`.\n", t.Kind().String(), t.Codec().MimeType)
+		s.handleTrack(r, user, t, rec)
+	})
 
-		// Handle stream subscriptions
-		defer r.handleStreamSubscriptions()
+	user.onScreenShareStopped = func(streamID string) {
+		s.broadcastScreenShare(r, user, "out/screenshare-stopped", streamID)
+	}
 
-		if t.Kind().String() == "video" {
-			user.addVideoTrack(t)
-			return
-		}
-		if t.Kind().String() == "audio" {
-			user.addAudioTrack(t)
-			return
-		}
+	user.pc.OnNegotiationNeeded(func() {
+		user.negotiation.enqueue(func() {
+			// pion fires again once the signaling state is stable.
+			if user.pc.SignalingState() != webrtc.SignalingStateStable {
+				return
+			}
+
+			offer, err := user.pc.CreateOffer(nil)
+			if err != nil {
+				return
+			}
+
+			if err := user.pc.SetLocalDescription(offer); err != nil {
+				return
+			}
+
+			s.sendToUser(r, user, &OutOffer{
+				Uri:    "out/offer",
+				ToUser: user,
+				Offer:  offer,
+			})
+			log.Printf("Requested ICE negotiation to %s \n", user.ID)
+		})
 	})
 
-	user.pc.OnNegotiationNeeded(func() {
-		offer, err := user.pc.CreateOffer(nil)
-		if err != nil {
-			return
+	if err := s.sendAnswer(r, conn, om.Offer); err != nil {
+		return err
+	}
+
+	// Opened once the first offer is answered, the SFU offers them to the
+	// user whatever data channels the user opened itself.
+	return user.openAppChannels(func(ordered bool, payload []byte) {
+		s.relayAppMessage(r, user, ordered, payload)
+	})
+}
+
+// handleTrack forwards a track published by the user to the room.
+func (s *chap7Handler) handleTrack(r *room, user *user, t *webrtc.TrackRemote, rec *webrtc.RTPReceiver) {
+	log.Printf("Received track: `%s` mimetype: `%s`.\n", t.Kind().String(), t.Codec().MimeType)
+
+	// The audience of webinars keeps its tracks, they are forwarded once
+	// the user is promoted to the stage.
+	if !user.canPublish() && !user.webinar {
+		log.Printf("Refusing `%s` track from subscriber `%s`", t.Kind().String(), user.ID)
+		if err := rec.Stop(); err != nil {
+			log.Print("Error: ", err.Error())
 		}
+		return
+	}
 
-		if err := user.pc.SetLocalDescription(offer); err != nil {
-			return
+	// Handle stream subscriptions
+	defer r.handleStreamSubscriptions(user)
+
+	if user.isScreenTrack(t) {
+		if user.addScreenTrack(t) {
+			go user.readPublisherRTCP("screen", t, rec)
+			s.broadcastScreenShare(r, user, "out/screenshare-started", t.StreamID())
+			s.notifyOperators(r, "out/track-added", user, newTrackDetail("screen", t))
 		}
+		return
+	}
+	if t.Kind().String() == "video" {
+		user.addVideoTrack(t)
+		go user.readPublisherRTCP("video", t, rec)
+		s.notifyOperators(r, "out/track-added", user, newTrackDetail("video", t))
+		return
+	}
+	if t.Kind().String() == "audio" {
+		user.addAudioTrack(t)
+		go user.readPublisherRTCP("audio", t, rec)
+		s.notifyOperators(r, "out/track-added", user, newTrackDetail("audio", t))
+		return
+	}
+}
 
-		s.sendMessage(r, conn, &OutOffer{
-			Uri:    "out/offer",
-			ToUser: user,
-			Offer:  offer,
+// handleSetLayer sets the simulcast layer forwarded from a publisher.
+func (s *chap7Handler) handleSetLayer(r *room, conn *websocket.Conn, messagePayload []byte) error {
+	user := r.getUser(conn)
+
+	m := InSetLayer{}
+	if err := json.Unmarshal(messagePayload, &m); err != nil {
+		return err
+	}
+
+	publisher := r.getUserByID(m.PublisherID)
+	if user == nil || publisher == nil {
+		return s.sendMessage(r, conn, &InfoMessage{
+			Uri:     "out/error",
+			Code:    errCodeNotFound,
+			Message: "User not found",
 		})
-		log.Printf("Requested ICE negotiation to %s \n", user.ID)
-	})
+	}
+
+	if err := publisher.setSubscriberLayer(user, m.Layer); err != nil {
+		return s.sendMessage(r, conn, &InfoMessage{
+			Uri:     "out/error",
+			Code:    errCodeInvalid,
+			Message: err.Error(),
+		})
+	}
+
+	log.Printf("User `%s` set layer `%s` for `%s`", user.ID, m.Layer, publisher.ID)
 
-	return s.sendAnswer(r, conn, om.Offer)
+	return nil
 }
 
-func (s *chap7Handler) handleUserJoin(r *room, conn *websocket.Conn, payload []byte) error {
-	eventURI := "out/user-join"
+// handlePin pins or unpins a publisher so its video is forwarded whatever
+// the room Last-N.
+func (s *chap7Handler) handlePin(r *room, conn *websocket.Conn, messagePayload []byte) error {
+	user := r.getUser(conn)
+
+	m := InPin{}
+	if err := json.Unmarshal(messagePayload, &m); err != nil {
+		return err
+	}
+
+	if user == nil || r.getUserByID(m.PublisherID) == nil {
+		return s.sendMessage(r, conn, &InfoMessage{
+			Uri:     "out/error",
+			Code:    errCodeNotFound,
+			Message: "User not found",
+		})
+	}
+
+	user.setPinned(m.PublisherID, m.Pinned)
+	r.updateLastN()
+
+	log.Printf("User `%s` pinned `%s`: %t", user.ID, m.PublisherID, m.Pinned)
+
+	return nil
+}
+
+// handleUserJoin adds the user to the room, or to its lobby. With tokens
+// enabled the name and role come from the token the connection was opened
+// with.
+func (s *chap7Handler) handleUserJoin(r *room, conn *websocket.Conn, claims *joinClaims, payload []byte) error {
+	if r.getUser(conn) != nil || r.inLobby(conn) {
+		return s.sendMessage(r, conn, &InfoMessage{
+			Uri:     "out/error",
+			Code:    errCodeInvalid,
+			Message: "already joined",
+		})
+	}
 
 	message := InUserJoinMessage{}
 	if err := json.Unmarshal(payload, &message); err != nil {
-		panic(err)
+		return s.sendMessage(r, conn, &InfoMessage{
+			Uri:     "out/error",
+			Code:    errCodeInvalid,
+			Message: err.Error(),
+		})
 	}
 
-	user, err := s.userFactory.newUser(message.User)
+	if message.User == nil {
+		return s.sendMessage(r, conn, &InfoMessage{
+			Uri:     "out/error",
+			Code:    errCodeInvalid,
+			Message: "user missing on in/join",
+		})
+	}
+
+	username, role := message.User.Username, rolePublisher
+	if claims != nil {
+		username, role = claims.Name, claims.Role
+	}
+
+	if r.needsAdmission(role) {
+		return s.enterLobby(r, conn, username, role, message.User.StreamID)
+	}
+	return s.joinRoom(r, conn, username, role, message.User.StreamID)
+}
+
+func (s *chap7Handler) joinRoom(r *room, conn *websocket.Conn, username, role, streamID string) error {
+	// The SFU mints the ID, clients only choose their name.
+	user, err := s.userFactory.newUser(&user{
+		ID:       uuid.New().String(),
+		Username: username,
+		StreamID: streamID,
+		Role:     role,
+	})
 	if err != nil {
-		panic(err)
+		return s.sendMessage(r, conn, &InfoMessage{
+			Uri:     "out/error",
+			Code:    errCodeInternal,
+			Message: "the user could not be created",
+		})
+	}
+
+	if user.resumeToken, err = newSecret(); err != nil {
+		user.stop()
+		return s.sendMessage(r, conn, &InfoMessage{
+			Uri:     "out/error",
+			Code:    errCodeInternal,
+			Message: "the user could not be created",
+		})
 	}
 
 	if _, err = r.addUser(conn, user); err != nil {
+		user.stop()
+		code := errCodeRoomFull
+		switch err {
+		case ErrRoomLocked:
+			code = errCodeRoomLocked
+		case ErrRoomClosed:
+			code = errCodeRoomClosed
+		case ErrStreamIDInUse:
+			code = errCodeInvalid
+		}
 		return s.sendMessage(r, conn, &InfoMessage{
 			Uri:     "out/error",
+			Code:    code,
 			Message: err.Error(),
 		})
 	}
 
+	s.sendMessage(r, conn, &OutJoined{
+		Uri:         "out/joined",
+		User:        user,
+		ResumeToken: user.resumeToken,
+		GracePeriod: s.cfg.ResumeGracePeriod.Milliseconds(),
+		Audience:    !user.canPublish(),
+	})
+
+	s.announceJoin(r, user)
+
+	// Get the tracks already in the room. Users who never publish, like
+	// subscribers, are not subscribed anywhere else.
+	r.handleStreamSubscriptions(user)
+
+	s.sendMessage(r, conn, &OutChatHistory{
+		Uri:      "out/chat-history",
+		Messages: r.getChatHistory(),
+	})
+
+	if user.Role == roleModerator {
+		for _, req := range r.getLobby() {
+			s.sendMessage(r, conn, &OutLobbyEvent{
+				Uri:     "out/lobby-request",
+				RoomID:  r.ID,
+				Request: req,
+			})
+		}
+	}
+
+	// Let the new user know of the screens being shared.
+	for _, other := range r.getUserList() {
+		if screen := other.getScreenTrack(); screen != nil && other.ID != user.ID {
+			s.sendMessage(r, conn, &OutScreenShare{
+				Uri:      "out/screenshare-started",
+				User:     other,
+				StreamID: screen.StreamID(),
+			})
+		}
+	}
+	return nil
+}
+
+// announceJoin lets the room and the operators know of a new user.
+func (s *chap7Handler) announceJoin(r *room, user *user) {
 	for _, uconn := range r.getUserConnections() {
 		s.sendMessage(r, uconn, &OutUserEventMessage{
-			Uri:   eventURI,
-			User:  message.User,
+			Uri:   "out/user-join",
+			User:  user,
 			Users: r.getUserList(),
 		})
 	}
-	return nil
+
+	s.notifyOperators(r, "out/user-joined", user, nil)
 }
 
-func (s *chap7Handler) handleRoomDisconnection(r *room, conn *websocket.Conn) {
-	eventURI := "out/user-left"
+func (s *chap7Handler) broadcastScreenShare(r *room, user *user, eventURI, streamID string) {
+	for _, uconn := range r.getUserConnections() {
+		s.sendMessage(r, uconn, &OutScreenShare{
+			Uri:      eventURI,
+			User:     user,
+			StreamID: streamID,
+		})
+	}
+}
 
-	user := r.removeUser(conn)
+// handleActiveSpeaker lets the room participants and the operators know
+// who is speaking.
+func (s *chap7Handler) handleActiveSpeaker(r *room, speaker *user) {
+	m := &OutActiveSpeaker{
+		Uri:    "out/active-speaker",
+		RoomID: r.ID,
+		User:   speaker,
+	}
 
 	for _, uconn := range r.getUserConnections() {
-		s.sendMessage(r, uconn, &OutUserEventMessage{
-			Uri:   eventURI,
-			User:  user,
-			Users: r.getUserList(),
+		s.sendMessage(r, uconn, m)
+	}
+	s.roomFactory.notifyActiveSpeaker(m)
+
+	r.followSpeaker(speaker)
+}
+
+// How long the ICE connection of a user can stay disconnected before the
+// SFU restarts it.
+const iceDisconnectedTimeout = 5 * time.Second
+
+// restartICE sends the user an offer with new ICE credentials.
+func (s *chap7Handler) restartICE(r *room, user *user) error {
+	return user.negotiation.do(func() error {
+		if user.isStopped() || user.getConn() == nil {
+			// Detached users get restarted when they resume.
+			return nil
+		}
+
+		// pion can not roll back an offer still waiting for an answer. It
+		// is sent again and the restart follows its answer.
+		if user.pc.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+			user.iceRestartPending = true
+			log.Printf("ICE restart with user `%s` waits for the pending offer", user.ID)
+			return s.sendToUser(r, user, &OutOffer{
+				Uri:    "out/offer",
+				ToUser: user,
+				Offer:  *user.pc.LocalDescription(),
+			})
+		}
+		user.iceRestartPending = false
+
+		offer, err := user.pc.CreateOffer(&webrtc.OfferOptions{ICERestart: true})
+		if err != nil {
+			log.Print("Error: ", err.Error())
+			return err
+		}
+
+		if err := user.pc.SetLocalDescription(offer); err != nil {
+			log.Print("Error: ", err.Error())
+			return err
+		}
+
+		log.Printf("ICE restart with user `%s`", user.ID)
+
+		return s.sendToUser(r, user, &OutOffer{
+			Uri:    "out/offer",
+			ToUser: user,
+			Offer:  offer,
+		})
+	})
+}
+
+// handleResume attaches the connection to the session of a user which
+// dropped. The others in the room see no change.
+func (s *chap7Handler) handleResume(r *room, conn *websocket.Conn, payload []byte) error {
+	m := InResume{}
+	if err := json.Unmarshal(payload, &m); err != nil {
+		return err
+	}
+
+	// The user of the connection would be left behind in the room.
+	if r.getUser(conn) != nil || r.inLobby(conn) {
+		return s.sendMessage(r, conn, &InfoMessage{
+			Uri:     "out/error",
+			Code:    errCodeInvalid,
+			Message: "already joined",
 		})
 	}
 
+	user, oldConn, err := r.resumeUser(m.ResumeToken, conn)
+	if err != nil {
+		return s.sendMessage(r, conn, &InfoMessage{
+			Uri:     "out/error",
+			Code:    errCodeNoSession,
+			Message: err.Error(),
+		})
+	}
+	if oldConn != conn {
+		// The old connection may not have noticed it is gone.
+		oldConn.Close()
+	}
+
+	log.Printf("User `%s` resumed its session", user.ID)
+
+	s.sendMessage(r, conn, &OutUserEventMessage{
+		Uri:   "out/resumed",
+		User:  user,
+		Users: r.getUserList(),
+	})
+
+	switch user.pc.ICEConnectionState() {
+	case webrtc.ICEConnectionStateDisconnected, webrtc.ICEConnectionStateFailed:
+		return s.restartICE(r, user)
+	}
+	return s.resendOffer(r, user)
+}
+
+// resendOffer sends the user the offer still waiting for an answer. It was
+// dropped if it was made while the user was detached, and the user would
+// not negotiate again until it is answered.
+func (s *chap7Handler) resendOffer(r *room, user *user) error {
+	return user.negotiation.do(func() error {
+		if user.pc.SignalingState() != webrtc.SignalingStateHaveLocalOffer {
+			return nil
+		}
+
+		log.Printf("Sending the pending offer to user `%s` again", user.ID)
+
+		return s.sendToUser(r, user, &OutOffer{
+			Uri:    "out/offer",
+			ToUser: user,
+			Offer:  *user.pc.LocalDescription(),
+		})
+	})
+}
+
+// handleConnectionLost detaches the user of a dropped connection for the
+// grace period, then takes it out of the room unless it has resumed.
+func (s *chap7Handler) handleConnectionLost(r *room, conn *websocket.Conn) {
+	if s.cfg.ResumeGracePeriod <= 0 {
+		s.handleRoomDisconnection(r, conn)
+		return
+	}
+
+	user := r.detachUser(conn)
+	if user == nil {
+		s.handleRoomDisconnection(r, conn)
+		return
+	}
+
+	log.Printf("User `%s` detached, waiting %s to resume", user.ID, s.cfg.ResumeGracePeriod)
+
+	time.AfterFunc(s.cfg.ResumeGracePeriod, func() {
+		// A resumed user is no longer on the old connection.
+		if r.getUser(conn) == user {
+			s.handleRoomDisconnection(r, conn)
+		}
+	})
+}
+
+func (s *chap7Handler) handleRoomDisconnection(r *room, conn *websocket.Conn) {
+	eventURI := "out/user-left"
+
+	// The user is nil when the connection never joined the room.
+	if user := r.removeUser(conn); user != nil {
+		// Someone else may now be in the Last-N.
+		r.updateLastN()
+		r.reassignViewers(user)
+
+		s.notifyOperators(r, "out/user-left", user, nil)
+
+		for _, uconn := range r.getUserConnections() {
+			s.sendMessage(r, uconn, &OutUserEventMessage{
+				Uri:   eventURI,
+				User:  user,
+				Users: r.getUserList(),
+			})
+		}
+	}
+
+	if req := r.removeFromLobby(conn); req != nil {
+		s.notifyLobby(r, "out/lobby-left", req)
+	}
+
 	if s.roomFactory.deleteIfEmpty(r) {
 		log.Printf("Room `%s` has been deleted.", r.ID)
 	}
 }
 
-func (s *chap7Handler) handleRoomConnection(roomID string, conn *websocket.Conn) {
-	room := s.roomFactory.getOrCreate(roomID)
+// Messages only valid on a connection which has joined the room.
+var joinedURIs = map[string]bool{
+	"in/icecandidate": true,
+	"in/offer":        true,
+	"in/answer":       true,
+	"in/set-layer":    true,
+	"in/pin":          true,
+	"in/admit":        true,
+	"in/deny":         true,
+	"in/promote":      true,
+	"in/demote":       true,
+	"in/chat":         true,
+	"in/chat-delete":  true,
+}
+
+func (s *chap7Handler) handleRoomConnection(roomID string, settings roomSettings, claims *joinClaims, conn *websocket.Conn) {
+	room := s.roomFactory.getOrCreate(roomID, settings)
 	for {
 		_, messagePayload, err := conn.ReadMessage()
 		if err != nil {
 			log.Println("read err:", err)
-			s.handleRoomDisconnection(room, conn)
+			s.handleConnectionLost(room, conn)
 			break
 		}
 
@@ -223,19 +663,51 @@ func (s *chap7Handler) handleRoomConnection(roomID string, conn *websocket.Conn)
 			continue
 		}
 
+		if joinedURIs[m.Uri] && room.getUser(conn) == nil {
+			s.sendMessage(room, conn, &InfoMessage{
+				Uri:     "out/error",
+				Code:    errCodeNotJoined,
+				Message: "`" + m.Uri + "` is only valid after in/join",
+			})
+			log.Println("Message before join: ", m.Uri)
+			continue
+		}
+
+		switch m.Uri {
+		case "in/join", "in/resume":
+			// The room is deleted when the last user leaves, which may
+			// have happened since the connection was opened.
+			room = s.roomFactory.getOrCreate(roomID, settings)
+		}
+
 		switch m.Uri {
 		case "in/join":
-			s.handleUserJoin(room, conn, messagePayload)
+			s.handleUserJoin(room, conn, claims, messagePayload)
+		case "in/resume":
+			s.handleResume(room, conn, messagePayload)
 		case "in/icecandidate":
 			s.handleICECandidate(room, conn, messagePayload)
 		case "in/offer":
 			s.handleOffer(room, conn, messagePayload)
 		case "in/answer":
 			s.handleAnswer(room, conn, messagePayload)
+		case "in/set-layer":
+			s.handleSetLayer(room, conn, messagePayload)
+		case "in/pin":
+			s.handlePin(room, conn, messagePayload)
+		case "in/admit", "in/deny":
+			s.handleLobbyDecision(room, conn, messagePayload)
+		case "in/promote", "in/demote":
+			s.handleStageChange(room, conn, messagePayload)
+		case "in/chat":
+			s.handleChat(room, conn, messagePayload)
+		case "in/chat-delete":
+			s.handleChatDelete(room, conn, messagePayload)
 		case "in/pong":
 		default:
 			s.sendMessage(room, conn, &InfoMessage{
 				Uri:     "out/error",
+				Code:    errCodeUnknownURI,
 				Message: "Message uri not recognized",
 			})
 			log.Println("No handler for message type: ", m.Uri)
@@ -250,6 +722,31 @@ func (s *chap7Handler) RoomWS(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	claims, err := s.roomClaims(roomID, r.URL.Query().Get("token"))
+	if err != nil {
+		responses.Send(w, tokenErrorStatus(err), responses.NewError(err.Error()))
+		return
+	}
+
+	// Settings are optional and only apply when the room gets created.
+	settings := roomSettings{
+		record:  r.URL.Query().Get("record") == "true",
+		lobby:   r.URL.Query().Get("lobby") == "true",
+		webinar: r.URL.Query().Get("webinar") == "true",
+	}
+	if value := r.URL.Query().Get("capacity"); value != "" {
+		if settings.capacity, err = strconv.Atoi(value); err != nil || settings.capacity < 1 {
+			responses.Send(w, http.StatusBadRequest, responses.NewError("capacity must be a positive integer"))
+			return
+		}
+	}
+	if value := r.URL.Query().Get("lastN"); value != "" {
+		if settings.lastN, err = strconv.Atoi(value); err != nil || settings.lastN < 1 {
+			responses.Send(w, http.StatusBadRequest, responses.NewError("lastN must be a positive integer"))
+			return
+		}
+	}
+
 	c, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Print("upgrade:", err)
@@ -257,5 +754,5 @@ func (s *chap7Handler) RoomWS(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.handleRoomConnection(roomID, c)
+	s.handleRoomConnection(roomID, settings, claims, c)
 }
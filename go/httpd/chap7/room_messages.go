@@ -1,10 +1,29 @@
 package chap7
 
-import "github.com/pion/webrtc/v3"
+import (
+	"encoding/json"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// error codes sent along with `out/error` messages
+const (
+	errCodeRoomFull   = "room-full"
+	errCodeRoomLocked = "room-locked"
+	errCodeRoomClosed = "room-closed"
+	errCodeNoSession  = "session-not-found"
+	errCodeUnknownURI = "unknown-uri"
+	errCodeNotFound   = "not-found"
+	errCodeInvalid    = "invalid-request"
+	errCodeNotJoined  = "not-joined"
+	errCodeForbidden  = "forbidden"
+	errCodeInternal   = "internal-error"
+)
 
 // messages
 type InfoMessage struct {
 	Uri     string `json:"uri"`
+	Code    string `json:"code,omitempty"`
 	Message string `json:"message"`
 }
 
@@ -54,8 +73,123 @@ type InUserJoinMessage struct {
 	User *user `json:"user"`
 }
 
+// OutJoined answers `in/join` with the identity the SFU assigned to the
+// user and the token to resume the session.
+type OutJoined struct {
+	Uri         string `json:"uri"`
+	User        *user  `json:"user"`
+	ResumeToken string `json:"resumeToken"`
+	// Milliseconds
+	GracePeriod int64 `json:"gracePeriod"`
+	// Set for the audience of webinar rooms, which must not publish.
+	Audience bool `json:"audience,omitempty"`
+}
+
+type InResume struct {
+	ResumeToken string `json:"resumeToken"`
+}
+
 type OutUserEventMessage struct {
 	Uri   string  `json:"uri"`
 	User  *user   `json:"user"`
 	Users []*user `json:"roomUsers"`
 }
+
+type OutScreenShare struct {
+	Uri      string `json:"uri"`
+	User     *user  `json:"user"`
+	StreamID string `json:"streamID"`
+}
+
+type OutMuteEvent struct {
+	Uri  string `json:"uri"`
+	User *user  `json:"user"`
+	Kind string `json:"kind"`
+}
+
+type OutRoomEvent struct {
+	Uri      string `json:"uri"`
+	RoomID   string `json:"roomID"`
+	Capacity int    `json:"capacity,omitempty"`
+}
+
+type InPin struct {
+	PublisherID string `json:"publisherID"`
+	Pinned      bool   `json:"pinned"`
+}
+
+type InSetLayer struct {
+	PublisherID string `json:"publisherID"`
+	Layer       string `json:"layer"`
+}
+
+type OutActiveSpeaker struct {
+	Uri    string `json:"uri"`
+	RoomID string `json:"roomID"`
+	User   *user  `json:"user"`
+}
+
+type OutLobbyWaiting struct {
+	Uri     string `json:"uri"`
+	LobbyID string `json:"lobbyID"`
+}
+
+// Lobby requests and their outcome, sent to the room moderators.
+type OutLobbyEvent struct {
+	Uri     string        `json:"uri"`
+	RoomID  string        `json:"roomID"`
+	Request *lobbyRequest `json:"request"`
+}
+
+type InLobbyDecision struct {
+	Uri     string `json:"uri"`
+	LobbyID string `json:"lobbyID"`
+}
+
+// Sent to the room when a user of a webinar is moved to or off the stage.
+type OutStageEvent struct {
+	Uri    string `json:"uri"`
+	RoomID string `json:"roomID"`
+	User   *user  `json:"user"`
+}
+
+type InStageChange struct {
+	Uri    string `json:"uri"`
+	UserID string `json:"userID"`
+}
+
+type InChat struct {
+	Text string `json:"text"`
+	// Empty to send the message to the whole room.
+	ToUserID string `json:"toUserID,omitempty"`
+}
+
+type OutChat struct {
+	Uri     string       `json:"uri"`
+	Message *chatMessage `json:"message"`
+}
+
+// Sent on join with the last messages of the room.
+type OutChatHistory struct {
+	Uri      string         `json:"uri"`
+	Messages []*chatMessage `json:"messages"`
+}
+
+type InChatDelete struct {
+	MessageID string `json:"messageID"`
+}
+
+type OutChatDeleted struct {
+	Uri       string `json:"uri"`
+	MessageID string `json:"messageID"`
+}
+
+// appMessage is an application message sent on the app data channels.
+type appMessage struct {
+	// Set by the SFU to the id of the sender.
+	From string `json:"from"`
+	// Ids of the users the message is for, everybody else in the room
+	// when empty.
+	To   []string        `json:"to,omitempty"`
+	Data json.RawMessage `json:"data"`
+}
@@ -0,0 +1,655 @@
+package chap7
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andrefsp/video-democry/go/config"
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoom_addUserRespectsCapacity(t *testing.T) {
+	r := newRoom("room", 2, 0)
+
+	for i := 0; i < 2; i++ {
+		_, err := r.addUser(&websocket.Conn{}, &user{})
+		assert.Nil(t, err)
+	}
+
+	_, err := r.addUser(&websocket.Conn{}, &user{})
+	assert.Equal(t, ErrMaxUsersPerRoom, err)
+	assert.Len(t, r.getUserList(), 2)
+}
+
+func TestRoom_forwardedVideo(t *testing.T) {
+	r := newRoom("room", 10, 2)
+
+	users := map[string]*user{}
+	for _, id := range []string{"a", "b", "c", "d"} {
+		users[id] = &user{ID: id, pins: map[string]bool{}}
+		_, err := r.addUser(&websocket.Conn{}, users[id])
+		assert.Nil(t, err)
+	}
+
+	assert.Equal(t, map[string]bool{"b": true, "c": true}, r.forwardedVideo(users["a"]))
+
+	r.promoteSpeaker("d")
+	assert.Equal(t, map[string]bool{"d": true, "b": true}, r.forwardedVideo(users["a"]))
+	assert.Equal(t, map[string]bool{"a": true, "b": true}, r.forwardedVideo(users["d"]))
+
+	users["a"].setPinned("c", true)
+	assert.Equal(t, map[string]bool{"d": true, "b": true, "c": true}, r.forwardedVideo(users["a"]))
+}
+
+func TestRoom_updateLastN(t *testing.T) {
+	r := newRoom("room", 10, 1)
+
+	users := map[string]*user{}
+	for _, id := range []string{"a", "b", "c"} {
+		users[id] = newTestPublisher(id, mimeTypeVP8)
+		users[id].pins = map[string]bool{}
+		users[id].subscribers = map[string]*subscriberRTPSenders{}
+		_, err := r.addUser(&websocket.Conn{}, users[id])
+		assert.Nil(t, err)
+	}
+
+	for _, publisher := range users {
+		for _, subscriber := range users {
+			if publisher == subscriber {
+				continue
+			}
+			f, err := newVideoForwarder(publisher.videoCodec, publisher.ID)
+			assert.Nil(t, err)
+			publisher.subscribers[subscriber.ID] = &subscriberRTPSenders{subscriber: subscriber, videoForwarder: f}
+		}
+	}
+
+	paused := func(publisher, subscriber string) bool {
+		return users[publisher].subscribers[subscriber].videoForwarder.getStats().Paused
+	}
+
+	r.updateLastN()
+	assert.False(t, paused("b", "a"))
+	assert.True(t, paused("c", "a"))
+	assert.False(t, paused("a", "c"))
+	assert.True(t, paused("b", "c"))
+
+	// The video of a new speaker is resumed on the same forwarder.
+	r.promoteSpeaker("c")
+	r.updateLastN()
+	assert.True(t, paused("b", "a"))
+	assert.False(t, paused("c", "a"))
+
+	users["a"].setPinned("b", true)
+	r.updateLastN()
+	assert.False(t, paused("b", "a"))
+	assert.False(t, paused("c", "a"))
+	assert.True(t, paused("a", "b"))
+}
+
+func TestRoom_lockedRoomRejectsUsers(t *testing.T) {
+	r := newRoom("room", 2, 0)
+
+	r.setLocked(true)
+	_, err := r.addUser(&websocket.Conn{}, &user{})
+	assert.Equal(t, ErrRoomLocked, err)
+
+	r.setLocked(false)
+	_, err = r.addUser(&websocket.Conn{}, &user{})
+	assert.Nil(t, err)
+
+	assert.Equal(t, ErrInvalidCapacity, r.setCapacity(0))
+	assert.Nil(t, r.setCapacity(1))
+	_, err = r.addUser(&websocket.Conn{}, &user{})
+	assert.Equal(t, ErrMaxUsersPerRoom, err)
+}
+
+func TestRoom_resumeUser(t *testing.T) {
+	r := newRoom("room", 2, 0)
+
+	oldConn := &websocket.Conn{}
+	u := &user{ID: "a", resumeToken: "token"}
+	_, err := r.addUser(oldConn, u)
+	assert.Nil(t, err)
+
+	assert.Equal(t, u, r.detachUser(oldConn))
+	assert.Len(t, r.getUserConnections(), 0)
+
+	_, _, err = r.resumeUser("other", &websocket.Conn{})
+	assert.Equal(t, ErrSessionNotFound, err)
+
+	newConn := &websocket.Conn{}
+	resumed, previous, err := r.resumeUser("token", newConn)
+	assert.Nil(t, err)
+	assert.Equal(t, u, resumed)
+	assert.Equal(t, oldConn, previous)
+	assert.Equal(t, newConn, u.getConn())
+	assert.Nil(t, r.getUser(oldConn))
+	assert.Equal(t, []*websocket.Conn{newConn}, r.getUserConnections())
+}
+
+func TestRoom_addUserAssignsUniqueNames(t *testing.T) {
+	r := newRoom("room", 10, 0)
+
+	for _, name := range []string{"alice", "Alice", " alice ", ""} {
+		_, err := r.addUser(&websocket.Conn{}, &user{Username: name})
+		assert.Nil(t, err)
+	}
+
+	names := map[string]bool{}
+	for _, u := range r.getUserList() {
+		names[u.Username] = true
+	}
+	assert.Equal(t, map[string]bool{"alice": true, "Alice (2)": true, "alice (3)": true, "guest": true}, names)
+
+	_, err := r.addUser(&websocket.Conn{}, &user{StreamID: "stream"})
+	assert.Nil(t, err)
+	_, err = r.addUser(&websocket.Conn{}, &user{StreamID: "stream"})
+	assert.Equal(t, ErrStreamIDInUse, err)
+}
+
+func TestRoom_lobby(t *testing.T) {
+	r := newRoom("room", 2, 0)
+	assert.False(t, r.needsAdmission(rolePublisher))
+
+	r.lobbyEnabled = true
+	assert.True(t, r.needsAdmission(rolePublisher))
+	assert.False(t, r.needsAdmission(roleModerator))
+
+	conn := &websocket.Conn{}
+	assert.Nil(t, r.addToLobby(&lobbyRequest{ID: "a", conn: conn}))
+	assert.Nil(t, r.addToLobby(&lobbyRequest{ID: "b", conn: &websocket.Conn{}}))
+	assert.True(t, r.inLobby(conn))
+	assert.False(t, r.isEmpty())
+	assert.False(t, r.closeIfEmpty())
+
+	assert.Equal(t, "a", r.removeFromLobby(conn).ID)
+	assert.Nil(t, r.takeFromLobby("a"))
+	assert.Equal(t, "b", r.takeFromLobby("b").ID)
+	assert.True(t, r.isEmpty())
+
+	assert.True(t, r.closeIfEmpty())
+	assert.Equal(t, ErrRoomClosed, r.addToLobby(&lobbyRequest{ID: "c", conn: conn}))
+	_, err := r.addUser(conn, &user{})
+	assert.Equal(t, ErrRoomClosed, err)
+}
+
+func TestRoom_webinarStage(t *testing.T) {
+	r := newRoom("room", 10, 0)
+	r.webinar = true
+
+	moderator := &user{ID: "a", Role: roleModerator}
+	_, err := r.addUser(&websocket.Conn{}, moderator)
+	assert.Nil(t, err)
+
+	audience := &user{ID: "b", Role: rolePublisher}
+	_, err = r.addUser(&websocket.Conn{}, audience)
+	assert.Nil(t, err)
+
+	assert.True(t, moderator.canPublish())
+	assert.False(t, audience.canPublish())
+	assert.Equal(t, []string{"a"}, r.speakerOrder)
+
+	assert.True(t, audience.setOnStage(true))
+	assert.False(t, audience.setOnStage(true))
+	assert.True(t, audience.canPublish())
+}
+
+func TestHandler_resumeResendsPendingOffer(t *testing.T) {
+	s := newTestHandler()
+	r := s.roomFactory.getOrCreate("room", roomSettings{})
+
+	u, err := s.userFactory.newUser(&user{ID: "a"})
+	assert.Nil(t, err)
+	u.resumeToken = "token"
+	defer u.stop()
+
+	oldConn := newTestConn(t)
+	_, err = r.addUser(oldConn, u)
+	assert.Nil(t, err)
+	r.detachUser(oldConn)
+
+	// An offer made while the user is detached is dropped.
+	_, err = u.pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio)
+	assert.Nil(t, err)
+	offer, err := u.pc.CreateOffer(nil)
+	assert.Nil(t, err)
+	assert.Nil(t, u.pc.SetLocalDescription(offer))
+
+	conn, client := newTestConnPair(t)
+	assert.Nil(t, s.handleResume(r, conn, []byte(`{"resumeToken":"token"}`)))
+
+	for _, uri := range []string{"out/resumed", "out/offer"} {
+		m := OutOffer{}
+		assert.Nil(t, client.ReadJSON(&m))
+		assert.Equal(t, uri, m.Uri)
+		if uri == "out/offer" {
+			assert.Equal(t, webrtc.SDPTypeOffer, m.Offer.Type)
+		}
+	}
+}
+
+func TestHandler_offerCollision(t *testing.T) {
+	s := newTestHandler()
+	r := s.roomFactory.getOrCreate("room", roomSettings{})
+
+	u, err := s.userFactory.newUser(&user{ID: "a"})
+	assert.Nil(t, err)
+	defer u.stop()
+
+	conn, client := newTestConnPair(t)
+	client.SetReadDeadline(time.Now().Add(3 * time.Second))
+	_, err = r.addUser(conn, u)
+	assert.Nil(t, err)
+
+	_, err = u.pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio)
+	assert.Nil(t, err)
+	offer, err := u.pc.CreateOffer(nil)
+	assert.Nil(t, err)
+	assert.Nil(t, u.pc.SetLocalDescription(offer))
+
+	peer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	assert.Nil(t, err)
+	defer peer.Close()
+	_, err = peer.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo)
+	assert.Nil(t, err)
+	peerOffer, err := peer.CreateOffer(nil)
+	assert.Nil(t, err)
+
+	// The SFU keeps its offer and sends it again instead of answering.
+	assert.Nil(t, s.sendAnswer(r, conn, peerOffer))
+	m := OutOffer{}
+	assert.Nil(t, client.ReadJSON(&m))
+	assert.Equal(t, "out/offer", m.Uri)
+	assert.Equal(t, iceUfrag(offer.SDP), iceUfrag(m.Offer.SDP))
+	assert.Equal(t, webrtc.SignalingStateHaveLocalOffer, u.pc.SignalingState())
+}
+
+// iceUfrag returns the ICE username fragment of the SDP.
+func iceUfrag(sdp string) string {
+	for _, line := range strings.Split(sdp, "\r\n") {
+		if strings.HasPrefix(line, "a=ice-ufrag:") {
+			return strings.TrimPrefix(line, "a=ice-ufrag:")
+		}
+	}
+	return ""
+}
+
+func TestHandler_restartICE(t *testing.T) {
+	s := newTestHandler()
+	r := s.roomFactory.getOrCreate("room", roomSettings{})
+
+	u, err := s.userFactory.newUser(&user{ID: "a"})
+	assert.Nil(t, err)
+	u.resumeToken = "token"
+	defer u.stop()
+
+	oldConn := newTestConn(t)
+	_, err = r.addUser(oldConn, u)
+	assert.Nil(t, err)
+
+	_, err = u.pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio)
+	assert.Nil(t, err)
+	offer, err := u.pc.CreateOffer(nil)
+	assert.Nil(t, err)
+	assert.Nil(t, u.pc.SetLocalDescription(offer))
+
+	// Detached users are restarted once they resume.
+	r.detachUser(oldConn)
+	assert.Nil(t, s.restartICE(r, u))
+	assert.False(t, u.iceRestartPending)
+
+	conn, client := newTestConnPair(t)
+	client.SetReadDeadline(time.Now().Add(3 * time.Second))
+	assert.Nil(t, s.handleResume(r, conn, []byte(`{"resumeToken":"token"}`)))
+	for _, uri := range []string{"out/resumed", "out/offer"} {
+		m := OutOffer{}
+		assert.Nil(t, client.ReadJSON(&m))
+		assert.Equal(t, uri, m.Uri)
+	}
+
+	// The pending offer is sent again, the restart follows its answer.
+	assert.Nil(t, s.restartICE(r, u))
+	m := OutOffer{}
+	assert.Nil(t, client.ReadJSON(&m))
+	assert.Equal(t, "out/offer", m.Uri)
+	assert.Equal(t, iceUfrag(offer.SDP), iceUfrag(m.Offer.SDP))
+
+	peer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	assert.Nil(t, err)
+	defer peer.Close()
+	assert.Nil(t, peer.SetRemoteDescription(m.Offer))
+	answer, err := peer.CreateAnswer(nil)
+	assert.Nil(t, err)
+	assert.Nil(t, peer.SetLocalDescription(answer))
+
+	payload, err := json.Marshal(&InAnswer{Answer: answer})
+	assert.Nil(t, err)
+	assert.Nil(t, s.handleAnswer(r, conn, payload))
+
+	m = OutOffer{}
+	assert.Nil(t, client.ReadJSON(&m))
+	assert.Equal(t, "out/offer", m.Uri)
+	assert.Equal(t, webrtc.SDPTypeOffer, m.Offer.Type)
+	assert.NotEqual(t, iceUfrag(offer.SDP), iceUfrag(m.Offer.SDP))
+	assert.Equal(t, webrtc.SignalingStateHaveLocalOffer, u.pc.SignalingState())
+}
+
+// newTestAudioPublisher returns a user publishing audio, without a peer
+// connection of its own.
+func newTestAudioPublisher(t *testing.T, id, role string) *user {
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: mimeTypeOpus}, "audio", id)
+	assert.Nil(t, err)
+
+	u := newTestPublisher(id, mimeTypeVP8)
+	u.Role = role
+	u.subscribers = map[string]*subscriberRTPSenders{}
+	u.audioOutTrack = track
+	return u
+}
+
+func TestUser_subscribeEachKindOnItsOwn(t *testing.T) {
+	publisherPC, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	assert.Nil(t, err)
+	defer publisherPC.Close()
+
+	subscriberPC, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	assert.Nil(t, err)
+	defer subscriberPC.Close()
+	subscriber := &user{ID: "b", pc: subscriberPC}
+
+	// Nothing to forward until the publisher has a track.
+	publisher := newTestPublisher("a", mimeTypeVP8)
+	publisher.pc = publisherPC
+	publisher.subscribers = map[string]*subscriberRTPSenders{}
+	assert.Nil(t, publisher.addSubscriber(subscriber))
+	assert.Len(t, publisher.subscribers, 0)
+
+	// Audio only.
+	publisher.audioOutTrack, err = webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: mimeTypeOpus}, "audio", "a")
+	assert.Nil(t, err)
+	assert.Nil(t, publisher.addSubscriber(subscriber))
+	senders := publisher.subscribers[subscriber.ID]
+	if !assert.NotNil(t, senders) {
+		return
+	}
+	audioSender := senders.audioRTPSender
+	assert.NotNil(t, audioSender)
+	assert.Nil(t, senders.videoRTPSender)
+
+	// The camera is turned on mid-call.
+	publisher.videoInTracks[""] = &webrtc.TrackRemote{}
+	assert.Nil(t, publisher.addSubscriber(subscriber))
+	assert.Equal(t, audioSender, senders.audioRTPSender)
+	assert.NotNil(t, senders.videoRTPSender)
+	assert.NotNil(t, senders.videoForwarder)
+
+	// Ended tracks are dropped, the subscription goes with the last one.
+	publisher.removeSubscriberTracks("audio")
+	assert.Nil(t, senders.audioRTPSender)
+	assert.Equal(t, senders, publisher.subscribers[subscriber.ID])
+
+	publisher.removeSubscriberTracks("video")
+	assert.Len(t, publisher.subscribers, 0)
+	assert.Len(t, subscriberPC.GetSenders(), 0)
+}
+
+func TestHandler_subscriberGetsExistingPublishers(t *testing.T) {
+	s := newTestHandler()
+	r := s.roomFactory.getOrCreate("room", roomSettings{})
+
+	publisher := newTestAudioPublisher(t, "a", rolePublisher)
+	_, err := r.addUser(newTestConn(t), publisher)
+	assert.Nil(t, err)
+
+	conn := newTestConn(t)
+	claims := &joinClaims{Room: r.ID, Name: "viewer", Role: roleSubscriber}
+	assert.Nil(t, s.handleUserJoin(r, conn, claims, []byte(`{"uri":"in/join","user":{}}`)))
+
+	subscriber := r.getUser(conn)
+	if !assert.NotNil(t, subscriber) {
+		return
+	}
+	defer s.handleRoomDisconnection(r, conn)
+
+	senders, subscribed := publisher.subscribers[subscriber.ID]
+	assert.True(t, subscribed)
+	if subscribed {
+		assert.NotNil(t, senders.audioRTPSender)
+	}
+}
+
+func TestHandler_audienceGetsExistingStage(t *testing.T) {
+	s := newTestHandler()
+	r := s.roomFactory.getOrCreate("room", roomSettings{webinar: true})
+
+	moderator := newTestAudioPublisher(t, "a", roleModerator)
+	_, err := r.addUser(newTestConn(t), moderator)
+	assert.Nil(t, err)
+
+	conn := newTestConn(t)
+	assert.Nil(t, s.joinRoom(r, conn, "guest", rolePublisher, ""))
+
+	audience := r.getUser(conn)
+	if !assert.NotNil(t, audience) {
+		return
+	}
+	defer s.handleRoomDisconnection(r, conn)
+	assert.False(t, audience.canPublish())
+
+	senders, subscribed := moderator.subscribers[audience.ID]
+	assert.True(t, subscribed)
+	if subscribed {
+		assert.NotNil(t, senders.audioRTPSender)
+	}
+}
+
+func TestHandler_screenShare(t *testing.T) {
+	s := newTestHandler()
+	r := s.roomFactory.getOrCreate("room", roomSettings{})
+
+	publisher := newTestAudioPublisher(t, "a", rolePublisher)
+	screen := &webrtc.TrackRemote{}
+	publisher.screenInTrack = screen
+	_, err := r.addUser(newTestConn(t), publisher)
+	assert.Nil(t, err)
+
+	// A user can only share one screen at a time.
+	assert.False(t, publisher.addScreenTrack(&webrtc.TrackRemote{}))
+
+	conn, client := newTestConnPair(t)
+	assert.Nil(t, s.joinRoom(r, conn, "guest", rolePublisher, ""))
+	joined := r.getUser(conn)
+	if !assert.NotNil(t, joined) {
+		return
+	}
+	defer s.handleRoomDisconnection(r, conn)
+
+	// The new user is told of the screen being shared and gets it.
+	client.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		m := OutScreenShare{}
+		if !assert.Nil(t, client.ReadJSON(&m)) {
+			return
+		}
+		if m.Uri == "out/screenshare-started" {
+			assert.Equal(t, publisher.ID, m.User.ID)
+			break
+		}
+	}
+
+	senders := publisher.subscribers[joined.ID]
+	if !assert.NotNil(t, senders) {
+		return
+	}
+	assert.NotNil(t, senders.screenRTPSender)
+	assert.NotNil(t, senders.screenForwarder)
+	assert.Nil(t, senders.videoRTPSender)
+
+	stopped := 0
+	publisher.onScreenShareStopped = func(streamID string) {
+		stopped++
+	}
+
+	// Only the track being shared ends the screen share.
+	publisher.removeScreenTrack(&webrtc.TrackRemote{})
+	assert.Equal(t, screen, publisher.getScreenTrack())
+
+	publisher.removeScreenTrack(screen)
+	assert.Nil(t, publisher.getScreenTrack())
+	assert.Nil(t, senders.screenRTPSender)
+	assert.NotNil(t, senders.audioRTPSender)
+	assert.Equal(t, 1, stopped)
+
+	publisher.removeScreenTrack(screen)
+	assert.Equal(t, 1, stopped)
+}
+
+func TestHandler_joinAfterRoomDeleted(t *testing.T) {
+	s := newTestHandler()
+
+	conn, client := newTestConnPair(t)
+	go s.handleRoomConnection("room", roomSettings{}, nil, conn)
+
+	// The connection holds the room until the last user in it leaves.
+	var deleted *room
+	for deleted == nil {
+		time.Sleep(time.Millisecond)
+		deleted = s.roomFactory.get("room")
+	}
+	s.handleRoomDisconnection(deleted, &websocket.Conn{})
+	assert.Nil(t, s.roomFactory.get("room"))
+
+	assert.Nil(t, client.WriteJSON(map[string]interface{}{"uri": "in/join", "user": map[string]string{}}))
+	m := message{}
+	assert.Nil(t, client.ReadJSON(&m))
+	assert.Equal(t, "out/joined", m.Uri)
+
+	r := s.roomFactory.get("room")
+	if assert.NotNil(t, r) {
+		assert.True(t, deleted != r)
+		assert.NotNil(t, r.getUser(conn))
+	}
+	client.Close()
+}
+
+func TestHandler_resumeFromJoinedConnection(t *testing.T) {
+	s := newTestHandler()
+	r := s.roomFactory.getOrCreate("room", roomSettings{})
+
+	detached := &user{ID: "a", resumeToken: "token"}
+	oldConn := &websocket.Conn{}
+	_, err := r.addUser(oldConn, detached)
+	assert.Nil(t, err)
+	r.detachUser(oldConn)
+
+	conn, client := newTestConnPair(t)
+	joined := &user{ID: "b"}
+	_, err = r.addUser(conn, joined)
+	assert.Nil(t, err)
+
+	assert.Nil(t, s.handleResume(r, conn, []byte(`{"resumeToken":"token"}`)))
+
+	m := InfoMessage{}
+	assert.Nil(t, client.ReadJSON(&m))
+	assert.Equal(t, "out/error", m.Uri)
+	assert.Equal(t, errCodeInvalid, m.Code)
+
+	assert.Equal(t, joined, r.getUser(conn))
+	assert.Equal(t, detached, r.getUser(oldConn))
+	assert.Nil(t, detached.getConn())
+}
+
+func TestHandler_joinErrors(t *testing.T) {
+	s := newTestHandler()
+	r := s.roomFactory.getOrCreate("room", roomSettings{})
+
+	conn, client := newTestConnPair(t)
+	assert.Nil(t, s.handleUserJoin(r, conn, nil, []byte(`{"uri":"in/join","user":"alice"}`)))
+
+	m := InfoMessage{}
+	assert.Nil(t, client.ReadJSON(&m))
+	assert.Equal(t, "out/error", m.Uri)
+	assert.Equal(t, errCodeInvalid, m.Code)
+
+	// The peer connection can not be created with an invalid ICE server.
+	s.userFactory.cfg = &config.Config{TurnServerAddr: "invalid"}
+	assert.Nil(t, s.handleUserJoin(r, conn, nil, []byte(`{"uri":"in/join","user":{}}`)))
+
+	assert.Nil(t, client.ReadJSON(&m))
+	assert.Equal(t, "out/error", m.Uri)
+	assert.Equal(t, errCodeInternal, m.Code)
+	assert.Nil(t, r.getUser(conn))
+}
+
+func TestHandler_messagesBeforeJoin(t *testing.T) {
+	s := newTestHandler()
+
+	conn, client := newTestConnPair(t)
+	client.SetReadDeadline(time.Now().Add(3 * time.Second))
+	done := make(chan struct{})
+	go func() {
+		s.handleRoomConnection("room", roomSettings{}, nil, conn)
+		close(done)
+	}()
+
+	for uri, code := range map[string]string{
+		"in/icecandidate": errCodeNotJoined,
+		"in/offer":        errCodeNotJoined,
+		"in/chat":         errCodeNotJoined,
+		"in/unknown":      errCodeUnknownURI,
+	} {
+		assert.Nil(t, client.WriteJSON(&message{Uri: uri}))
+		m := InfoMessage{}
+		assert.Nil(t, client.ReadJSON(&m))
+		assert.Equal(t, "out/error", m.Uri)
+		assert.Equal(t, code, m.Code, uri)
+	}
+
+	client.Close()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Connection not handled as lost")
+	}
+}
+
+func TestUser_addICECandidateBeforeDescription(t *testing.T) {
+	s := newTestHandler()
+	u, err := s.userFactory.newUser(&user{ID: "a"})
+	assert.Nil(t, err)
+	defer u.stop()
+
+	mid := "0"
+	candidate := webrtc.ICECandidateInit{
+		Candidate: "candidate:1 1 udp 2130706431 192.0.2.1 5000 typ host",
+		SDPMid:    &mid,
+	}
+
+	// Kept until the remote description is set, up to a limit.
+	for i := 0; i < maxPendingCandidates; i++ {
+		assert.Nil(t, u.addICECandidate(candidate))
+	}
+	assert.Equal(t, ErrTooManyCandidates, u.addICECandidate(candidate))
+	assert.Len(t, u.pendingCandidates, maxPendingCandidates)
+
+	peer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	assert.Nil(t, err)
+	defer peer.Close()
+	_, err = peer.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio)
+	assert.Nil(t, err)
+	offer, err := peer.CreateOffer(nil)
+	assert.Nil(t, err)
+
+	assert.Nil(t, u.pc.SetRemoteDescription(offer))
+	u.flushICECandidates()
+	assert.Len(t, u.pendingCandidates, 0)
+
+	// Then added straight away.
+	assert.Nil(t, u.addICECandidate(candidate))
+	assert.Len(t, u.pendingCandidates, 0)
+}
@@ -0,0 +1,76 @@
+package chap7
+
+// Simulcast layers as sent by the browser on the RID header extension.
+// Publishers which are not using simulcast have a single layer with an
+// empty RID.
+const (
+	layerQuarter = "q"
+	layerHalf    = "h"
+	layerFull    = "f"
+	layerAuto    = "auto"
+)
+
+// Ordered from the lowest to the highest quality.
+var simulcastLayers = []string{layerQuarter, layerHalf, layerFull}
+
+// Minimum estimated bitrate (bps) for a subscriber to receive each layer.
+var simulcastLayerBitrates = map[string]uint64{
+	layerQuarter: 0,
+	layerHalf:    500000,
+	layerFull:    1200000,
+}
+
+func isSimulcastLayer(layer string) bool {
+	_, ok := simulcastLayerBitrates[layer]
+	return ok
+}
+
+// selectLayer picks the layer to forward to a subscriber out of the
+// `available` layers of a publisher.
+// A `forced` layer wins if it is available, otherwise the highest layer
+// the `bitrate` estimate allows is chosen. With no estimate yet the half
+// layer is used as a starting point.
+func selectLayer(available map[string]bool, forced string, bitrate uint64) string {
+	if len(available) == 1 {
+		for layer := range available {
+			return layer
+		}
+	}
+
+	if forced != "" && available[forced] {
+		return forced
+	}
+
+	wanted := layerHalf
+	if bitrate > 0 {
+		wanted = layerQuarter
+		for _, layer := range simulcastLayers {
+			if bitrate >= simulcastLayerBitrates[layer] {
+				wanted = layer
+			}
+		}
+	}
+
+	if available[wanted] {
+		return wanted
+	}
+
+	// Fallback to the closest layer, lower layers first.
+	index := 0
+	for i, layer := range simulcastLayers {
+		if layer == wanted {
+			index = i
+		}
+	}
+	for i := index - 1; i >= 0; i-- {
+		if available[simulcastLayers[i]] {
+			return simulcastLayers[i]
+		}
+	}
+	for i := index + 1; i < len(simulcastLayers); i++ {
+		if available[simulcastLayers[i]] {
+			return simulcastLayers[i]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,23 @@
+package chap7
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSimulcast_selectLayer(t *testing.T) {
+	all := map[string]bool{layerQuarter: true, layerHalf: true, layerFull: true}
+
+	assert.Equal(t, layerHalf, selectLayer(all, "", 0))
+	assert.Equal(t, layerQuarter, selectLayer(all, "", 300000))
+	assert.Equal(t, layerHalf, selectLayer(all, "", 800000))
+	assert.Equal(t, layerFull, selectLayer(all, "", 2000000))
+	assert.Equal(t, layerQuarter, selectLayer(all, layerQuarter, 2000000))
+}
+
+func TestSimulcast_selectLayerFallback(t *testing.T) {
+	assert.Equal(t, "", selectLayer(map[string]bool{"": true}, layerFull, 0))
+	assert.Equal(t, layerHalf, selectLayer(map[string]bool{layerQuarter: true, layerHalf: true}, "", 2000000))
+	assert.Equal(t, layerHalf, selectLayer(map[string]bool{layerFull: true, layerHalf: true}, layerQuarter, 100000))
+}
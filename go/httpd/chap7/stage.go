@@ -0,0 +1,35 @@
+package chap7
+
+import "errors"
+
+var ErrNotWebinar = errors.New("Room is not a webinar")
+
+func (u *user) isOnStage() bool {
+	u.stageMutex.Lock()
+	defer u.stageMutex.Unlock()
+
+	return u.onStage
+}
+
+// setOnStage moves the user to or off the stage. It returns false if the
+// user was there already.
+func (u *user) setOnStage(onStage bool) bool {
+	u.stageMutex.Lock()
+	defer u.stageMutex.Unlock()
+
+	if u.onStage == onStage {
+		return false
+	}
+	u.onStage = onStage
+	return true
+}
+
+// removeFromSubscribers takes the tracks of the user off its subscribers,
+// which renegotiate without them. The tracks are still received, their
+// packets dropped while the user can not publish, so the user can be
+// promoted again without renegotiating.
+func (u *user) removeFromSubscribers() {
+	for _, kind := range []string{"audio", "video", "screen"} {
+		u.removeSubscriberTracks(kind)
+	}
+}
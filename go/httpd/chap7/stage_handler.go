@@ -0,0 +1,86 @@
+package chap7
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/gorilla/websocket"
+)
+
+// setStage promotes a user of a webinar to the stage or demotes it to the
+// audience. Promoted users renegotiate to publish their tracks, unless they
+// kept them while in the audience. The tracks of demoted users are dropped
+// by the SFU.
+func (s *chap7Handler) setStage(r *room, user *user, onStage bool) error {
+	if !r.webinar {
+		return ErrNotWebinar
+	}
+	if !user.setOnStage(onStage) {
+		return nil
+	}
+
+	eventURI := "out/promoted"
+	if onStage {
+		r.promoteSpeaker(user.ID)
+		r.handleStreamSubscriptions(user)
+	} else {
+		eventURI = "out/demoted"
+		user.removeFromSubscribers()
+		r.removeSpeaker(user.ID)
+		r.reassignViewers(user)
+		r.updateLastN()
+	}
+
+	log.Printf("User `%s` on the stage of room `%s`: %t", user.ID, r.ID, onStage)
+
+	s.broadcast(r, &OutStageEvent{
+		Uri:    eventURI,
+		RoomID: r.ID,
+		User:   user,
+	})
+	s.notifyOperators(r, eventURI, user, nil)
+	return nil
+}
+
+// handleStageChange promotes or demotes a user on behalf of a moderator in
+// the room.
+func (s *chap7Handler) handleStageChange(r *room, conn *websocket.Conn, payload []byte) error {
+	m := InStageChange{}
+	if err := json.Unmarshal(payload, &m); err != nil {
+		return err
+	}
+
+	if user := r.getUser(conn); user.Role != roleModerator {
+		return s.sendMessage(r, conn, &InfoMessage{
+			Uri:     "out/error",
+			Code:    errCodeForbidden,
+			Message: "Only moderators can change the stage",
+		})
+	}
+
+	user := r.getUserByID(m.UserID)
+	if user == nil {
+		return s.sendMessage(r, conn, &InfoMessage{
+			Uri:     "out/error",
+			Code:    errCodeNotFound,
+			Message: ErrUserNotFound.Error(),
+		})
+	}
+
+	if err := s.setStage(r, user, m.Uri == "in/promote"); err != nil {
+		return s.sendMessage(r, conn, &InfoMessage{
+			Uri:     "out/error",
+			Code:    errCodeInvalid,
+			Message: err.Error(),
+		})
+	}
+	return nil
+}
+
+func (s *chap7Handler) stageUser(op *operator, r *room, m *InOperatorCommand) error {
+	user := r.getUserByID(m.UserID)
+	if user == nil {
+		return ErrUserNotFound
+	}
+	return s.setStage(r, user, m.Uri == "in/promote")
+}
@@ -0,0 +1,263 @@
+package chap7
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+// Interval between the RTCP reports sent by the SFU.
+const rtcpReportInterval = time.Second
+
+// SSRC of the RTCP reports sent by the SFU.
+const rtcpSenderSSRC = 0x5346550a
+
+type streamStats struct {
+	Kind         string  `json:"kind"`
+	Layer        string  `json:"layer,omitempty"`
+	Packets      uint64  `json:"packets"`
+	Bytes        uint64  `json:"bytes"`
+	Bitrate      uint64  `json:"bitrate"`
+	PacketsLost  int64   `json:"packetsLost"`
+	FractionLost float64 `json:"fractionLost"`
+	// Milliseconds
+	Jitter float64 `json:"jitter"`
+}
+
+type subscriberStats struct {
+	SubscriberID string `json:"subscriberID"`
+	BytesSent    uint64 `json:"bytesSent"`
+	VideoLayer   string `json:"videoLayer"`
+	// From the subscriber receiver reports on the video.
+	PacketsLost  uint32  `json:"packetsLost"`
+	FractionLost float64 `json:"fractionLost"`
+	Jitter       float64 `json:"jitter"`
+	RTT          float64 `json:"rtt"`
+}
+
+type userStats struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	// Milliseconds, averaged over the videos the user receives.
+	RTT         float64            `json:"rtt"`
+	Inbound     []*streamStats     `json:"inbound"`
+	Subscribers []*subscriberStats `json:"subscribers"`
+}
+
+type roomStats struct {
+	ID    string       `json:"id"`
+	Users []*userStats `json:"users"`
+}
+
+// ntpTime returns the NTP timestamp (RFC 3550 section 4) of `t`.
+func ntpTime(t time.Time) uint64 {
+	// Seconds between the NTP epoch (1900) and the unix epoch.
+	seconds := uint64(t.Unix()) + 2208988800
+	fraction := uint64(t.Nanosecond()) * (1 << 32) / uint64(time.Second)
+	return seconds<<32 | fraction
+}
+
+// ntpMiddle returns the middle 32 bits of the NTP timestamp of `t`, as used
+// by the receiver reports to refer to a sender report.
+func ntpMiddle(t time.Time) uint32 {
+	return uint32(ntpTime(t) >> 16)
+}
+
+// rtpStats collects the statistics of a stream received by the SFU, as
+// reported in RTCP receiver reports (RFC 3550 appendix A).
+type rtpStats struct {
+	mutex sync.Mutex
+
+	kind      string
+	layer     string
+	clockRate uint32
+
+	started   bool
+	ssrc      uint32
+	startTime time.Time
+	baseSeq   uint32
+	// Extended with the sequence number cycles.
+	maxSeq  uint32
+	packets uint64
+	bytes   uint64
+
+	// Counts at the last report, for the fraction lost.
+	expectedPrior uint64
+	receivedPrior uint64
+	fractionLost  uint8
+
+	// Interarrival jitter, in timestamp units.
+	transit uint32
+	jitter  float64
+
+	bitrate     uint64
+	sampleBytes uint64
+	sampleTime  time.Time
+
+	lastSenderReport     uint32
+	lastSenderReportTime time.Time
+}
+
+func (s *rtpStats) update(packet *rtp.Packet, arrival time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.started {
+		s.started = true
+		s.ssrc = packet.SSRC
+		s.startTime = arrival
+		s.baseSeq = uint32(packet.SequenceNumber)
+		s.maxSeq = s.baseSeq
+		s.sampleTime = arrival
+	} else if delta := int16(packet.SequenceNumber - uint16(s.maxSeq)); delta > 0 {
+		s.maxSeq += uint32(delta)
+	}
+
+	s.packets++
+	s.bytes += uint64(packet.MarshalSize())
+
+	transit := uint32(uint64(arrival.Sub(s.startTime)) * uint64(s.clockRate) / uint64(time.Second))
+	transit -= packet.Timestamp
+	if s.packets > 1 {
+		d := float64(int32(transit - s.transit))
+		if d < 0 {
+			d = -d
+		}
+		s.jitter += (d - s.jitter) / 16
+	}
+	s.transit = transit
+
+	if elapsed := arrival.Sub(s.sampleTime); elapsed >= time.Second {
+		s.bitrate = (s.bytes - s.sampleBytes) * 8 * uint64(time.Second) / uint64(elapsed)
+		s.sampleBytes = s.bytes
+		s.sampleTime = arrival
+	}
+}
+
+func (s *rtpStats) updateSenderReport(report *rtcp.SenderReport, arrival time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.lastSenderReport = uint32(report.NTPTime >> 16)
+	s.lastSenderReportTime = arrival
+}
+
+func (s *rtpStats) lost() int64 {
+	return int64(s.maxSeq-s.baseSeq+1) - int64(s.packets)
+}
+
+// receptionReport returns the report block for the stream and starts a
+// new interval for the fraction lost.
+func (s *rtpStats) receptionReport(now time.Time) (rtcp.ReceptionReport, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.started {
+		return rtcp.ReceptionReport{}, false
+	}
+
+	expected := uint64(s.maxSeq-s.baseSeq) + 1
+	expectedInterval := expected - s.expectedPrior
+	lostInterval := int64(expectedInterval) - int64(s.packets-s.receivedPrior)
+	s.expectedPrior = expected
+	s.receivedPrior = s.packets
+
+	s.fractionLost = 0
+	if expectedInterval > 0 && lostInterval > 0 {
+		s.fractionLost = uint8((lostInterval << 8) / int64(expectedInterval))
+	}
+
+	// The total lost is a 24 bits signed value.
+	totalLost := s.lost()
+	if totalLost < 0 {
+		totalLost = 0
+	} else if totalLost > 0x7fffff {
+		totalLost = 0x7fffff
+	}
+
+	delay := uint32(0)
+	if s.lastSenderReport != 0 {
+		delay = uint32(now.Sub(s.lastSenderReportTime) * 65536 / time.Second)
+	}
+
+	return rtcp.ReceptionReport{
+		SSRC:               s.ssrc,
+		FractionLost:       s.fractionLost,
+		TotalLost:          uint32(totalLost),
+		LastSequenceNumber: s.maxSeq,
+		Jitter:             uint32(s.jitter),
+		LastSenderReport:   s.lastSenderReport,
+		Delay:              delay,
+	}, true
+}
+
+func (s *rtpStats) getStats() *streamStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	bitrate := s.bitrate
+	if time.Since(s.sampleTime) > 2*time.Second {
+		// Nothing received lately.
+		bitrate = 0
+	}
+
+	lost := int64(0)
+	if s.started {
+		lost = s.lost()
+	}
+
+	return &streamStats{
+		Kind:         s.kind,
+		Layer:        s.layer,
+		Packets:      s.packets,
+		Bytes:        s.bytes,
+		Bitrate:      bitrate,
+		PacketsLost:  lost,
+		FractionLost: float64(s.fractionLost) / 256,
+		Jitter:       s.jitter * 1000 / float64(s.clockRate),
+	}
+}
+
+func newRTPStats(kind, layer string, clockRate uint32) *rtpStats {
+	if clockRate == 0 {
+		clockRate = 90000
+	}
+	return &rtpStats{
+		kind:      kind,
+		layer:     layer,
+		clockRate: clockRate,
+	}
+}
+
+func (r *room) getStats() *roomStats {
+	stats := &roomStats{
+		ID:    r.ID,
+		Users: []*userStats{},
+	}
+
+	users := r.getUserList()
+	for _, user := range users {
+		stats.Users = append(stats.Users, user.getStats())
+	}
+
+	// The RTT of a user is measured on the videos it receives, which are
+	// part of the publisher stats.
+	for _, us := range stats.Users {
+		total, count := 0.0, 0
+		for _, publisher := range stats.Users {
+			for _, ss := range publisher.Subscribers {
+				if ss.SubscriberID == us.ID && ss.RTT > 0 {
+					total += ss.RTT
+					count++
+				}
+			}
+		}
+		if count > 0 {
+			us.RTT = total / float64(count)
+		}
+	}
+
+	return stats
+}
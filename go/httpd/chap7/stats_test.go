@@ -0,0 +1,31 @@
+package chap7
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRTPStats_receptionReport(t *testing.T) {
+	s := newRTPStats("video", "", 90000)
+
+	now := time.Now()
+	for _, seq := range []uint16{65534, 65535, 1, 2} {
+		s.update(&rtp.Packet{Header: rtp.Header{SSRC: 10, SequenceNumber: seq}}, now)
+	}
+
+	report, ok := s.receptionReport(now)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(10), report.SSRC)
+	assert.Equal(t, uint32(1), report.TotalLost)
+	assert.Equal(t, uint32(1<<16|2), report.LastSequenceNumber)
+	// 1 out of 5 packets.
+	assert.Equal(t, uint8(51), report.FractionLost)
+
+	s.update(&rtp.Packet{Header: rtp.Header{SSRC: 10, SequenceNumber: 3}}, now)
+	report, _ = s.receptionReport(now)
+	assert.Equal(t, uint8(0), report.FractionLost)
+	assert.Equal(t, int64(1), s.getStats().PacketsLost)
+}
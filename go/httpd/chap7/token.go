@@ -0,0 +1,90 @@
+package chap7
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Roles a join token can grant.
+const (
+	rolePublisher  = "publisher"
+	roleSubscriber = "subscriber"
+	roleModerator  = "moderator"
+)
+
+var (
+	ErrInvalidToken = errors.New("Invalid token")
+	ErrTokenExpired = errors.New("Token expired")
+	ErrInvalidRole  = errors.New("Invalid role")
+	ErrTokenRoom    = errors.New("Token is for another room")
+)
+
+// Header of every token, only HS256 is supported.
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// joinClaims are the claims of a JWT letting its holder join a room.
+type joinClaims struct {
+	Room      string `json:"room"`
+	Name      string `json:"name"`
+	Role      string `json:"role"`
+	ExpiresAt int64  `json:"exp"`
+	IssuedAt  int64  `json:"iat"`
+}
+
+func validRole(role string) bool {
+	return role == rolePublisher || role == roleSubscriber || role == roleModerator
+}
+
+func signature(secret, signed string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signToken returns the HMAC-SHA256 signed JWT of `claims`.
+func signToken(secret string, claims *joinClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + signature(secret, signed), nil
+}
+
+// parseToken checks the signature and expiry of a token made by signToken
+// and returns its claims.
+func parseToken(secret, token string, now time.Time) (*joinClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != tokenHeader {
+		return nil, ErrInvalidToken
+	}
+
+	expected := signature(secret, parts[0]+"."+parts[1])
+	if !hmac.Equal([]byte(expected), []byte(parts[2])) {
+		return nil, ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	claims := &joinClaims{}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if !validRole(claims.Role) {
+		return nil, ErrInvalidRole
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return nil, ErrTokenExpired
+	}
+
+	return claims, nil
+}
@@ -0,0 +1,123 @@
+package chap7
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/andrefsp/video-democry/go/httpd/responses"
+)
+
+// Lifetime of the tokens minted without a TTL.
+const defaultTokenTTL = time.Hour
+
+type InMintToken struct {
+	Room string `json:"room"`
+	Name string `json:"name"`
+	Role string `json:"role"`
+	// Seconds
+	TTL int64 `json:"ttl"`
+}
+
+type OutToken struct {
+	Token     string `json:"token"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+// roomClaims returns the claims of a token valid for the room. They are
+// nil when tokens are not enabled.
+func (s *chap7Handler) roomClaims(roomID, token string) (*joinClaims, error) {
+	if s.cfg.TokenSecret == "" {
+		return nil, nil
+	}
+
+	claims, err := parseToken(s.cfg.TokenSecret, token, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if claims.Room != roomID {
+		return nil, ErrTokenRoom
+	}
+	return claims, nil
+}
+
+func tokenErrorStatus(err error) int {
+	if err == ErrTokenRoom {
+		return http.StatusForbidden
+	}
+	return http.StatusUnauthorized
+}
+
+// bearerToken returns the token of the request Authorization header.
+func bearerToken(r *http.Request) string {
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// isOperator tells whether the request bears the operator secret. It is
+// only taken from the Authorization header so it does not end up in the
+// logs. Without an operator secret anyone is an operator, unless the rooms
+// need tokens.
+func (s *chap7Handler) isOperator(r *http.Request) bool {
+	if s.cfg.OperatorSecret == "" {
+		return s.cfg.TokenSecret == ""
+	}
+	return subtle.ConstantTimeCompare([]byte(bearerToken(r)), []byte(s.cfg.OperatorSecret)) == 1
+}
+
+// MintToken signs join tokens for the backend, which authenticates with
+// the token secret as bearer.
+func (s *chap7Handler) MintToken(w http.ResponseWriter, r *http.Request) {
+	if s.cfg.TokenSecret == "" {
+		responses.Send(w, http.StatusNotFound, responses.NewError("tokens are not enabled"))
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(bearerToken(r)), []byte(s.cfg.TokenSecret)) != 1 {
+		responses.Send(w, http.StatusUnauthorized, responses.NewError("unauthorized"))
+		return
+	}
+
+	m := InMintToken{}
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		responses.Send(w, http.StatusBadRequest, responses.NewError(err.Error()))
+		return
+	}
+	if m.Room == "" {
+		responses.Send(w, http.StatusBadRequest, responses.NewError("room not present on request"))
+		return
+	}
+	if m.Role == "" {
+		m.Role = rolePublisher
+	}
+	if !validRole(m.Role) {
+		responses.Send(w, http.StatusBadRequest, responses.NewError(ErrInvalidRole.Error()))
+		return
+	}
+
+	ttl := defaultTokenTTL
+	if m.TTL > 0 {
+		ttl = time.Duration(m.TTL) * time.Second
+	}
+
+	now := time.Now()
+	claims := &joinClaims{
+		Room:      m.Room,
+		Name:      m.Name,
+		Role:      m.Role,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+	}
+
+	token, err := signToken(s.cfg.TokenSecret, claims)
+	if err != nil {
+		responses.Send(w, http.StatusInternalServerError, responses.NewError(err.Error()))
+		return
+	}
+
+	responses.Send(w, http.StatusOK, &OutToken{
+		Token:     token,
+		ExpiresAt: claims.ExpiresAt,
+	})
+}
@@ -0,0 +1,35 @@
+package chap7
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToken_signAndParse(t *testing.T) {
+	now := time.Now()
+	claims := &joinClaims{
+		Room:      "room",
+		Name:      "alice",
+		Role:      roleSubscriber,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(time.Minute).Unix(),
+	}
+
+	token, err := signToken("secret", claims)
+	assert.Nil(t, err)
+
+	parsed, err := parseToken("secret", token, now)
+	assert.Nil(t, err)
+	assert.Equal(t, claims, parsed)
+
+	_, err = parseToken("other", token, now)
+	assert.Equal(t, ErrInvalidToken, err)
+
+	_, err = parseToken("secret", token+"x", now)
+	assert.Equal(t, ErrInvalidToken, err)
+
+	_, err = parseToken("secret", token, now.Add(time.Minute))
+	assert.Equal(t, ErrTokenExpired, err)
+}
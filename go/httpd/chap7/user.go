@@ -1,19 +1,54 @@
 package chap7
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v3"
 
 	"github.com/andrefsp/video-democry/go/config"
 )
 
+// Minimum interval between keyframe requests to a publisher layer.
+const keyframeRequestInterval = 500 * time.Millisecond
+
+// Screen share keyframes are large and the content changes little, so
+// they are requested less often.
+const screenKeyframeRequestInterval = 2 * time.Second
+
+// ICE candidates kept at most while waiting for the remote description.
+const maxPendingCandidates = 64
+
+var (
+	ErrInvalidLayer      = errors.New("Invalid simulcast layer")
+	ErrNotSubscribed     = errors.New("Not subscribed to user")
+	ErrInvalidKind       = errors.New("Invalid track kind")
+	ErrTooManyCandidates = errors.New("Too many ICE candidates before the remote description")
+)
+
+// Senders of each kind are nil until the publisher has a track of that
+// kind.
 type subscriberRTPSenders struct {
+	subscriber *user
+
 	videoRTPSender *webrtc.RTPSender
 	audioRTPSender *webrtc.RTPSender
+
+	videoForwarder *videoForwarder
+
+	screenRTPSender *webrtc.RTPSender
+	screenForwarder *videoForwarder
+
+	// Audio bytes sent by the publisher when the subscription started.
+	audioBytesStart uint64
 }
 
 // models
@@ -21,54 +56,203 @@ type user struct {
 	ID       string `json:"id"`
 	Username string `json:"username"`
 	StreamID string `json:"streamID"`
+	// One of the join token roles.
+	Role string `json:"role"`
+
+	joinedAt time.Time
+
+	// Connection the user is signaling on. It is nil while the user is
+	// detached, waiting to resume the session with `resumeToken`.
+	connMutex   sync.Mutex
+	conn        *websocket.Conn
+	resumeToken string
 
 	subscribersMutex sync.RWMutex
 	subscribers      map[string]*subscriberRTPSenders
 
-	pc *webrtc.PeerConnection
+	pc          *webrtc.PeerConnection
+	mediaEngine *webrtc.MediaEngine
+	negotiation *negotiationQueue
+	// Set when an ICE restart waits for the pending offer to be answered.
+	// Only used from the negotiation queue.
+	iceRestartPending bool
+
+	// Set for WHIP publishers. They have no websocket, only publish and
+	// are kept in the room under a placeholder connection.
+	ingest bool
+	// Secret in the URL of the WHIP resource. The user ID is known to
+	// the whole room.
+	resource string
+
+	// In webinar rooms only the users on the stage publish, the rest of
+	// the room is the audience.
+	webinar    bool
+	stageMutex sync.Mutex
+	onStage    bool
+
+	// Data channels for the app messages, opened by the SFU.
+	appChannelsMutex    sync.Mutex
+	appChannel          *webrtc.DataChannel
+	appUnorderedChannel *webrtc.DataChannel
+
+	// ICE candidates received before the remote description.
+	candidatesMutex   sync.Mutex
+	pendingCandidates []webrtc.ICECandidateInit
 
 	audioMutex    sync.Mutex
 	audioInTrack  *webrtc.TrackRemote
 	audioOutTrack *webrtc.TrackLocalStaticRTP
 
+	// Video tracks by simulcast layer. Publishers without simulcast have
+	// a single track on the empty layer.
 	videoMutex    sync.Mutex
-	videoInTrack  *webrtc.TrackRemote
-	videoOutTrack *webrtc.TrackLocalStaticRTP
+	videoCodec    webrtc.RTPCodecParameters
+	videoInTracks map[string]*webrtc.TrackRemote
+
+	// Last keyframe request sent to the publisher by layer.
+	keyframeRequests map[string]time.Time
+
+	// Screen share, a second video track on a stream other than
+	// `StreamID`.
+	screenMutex           sync.Mutex
+	screenInTrack         *webrtc.TrackRemote
+	screenKeyframeRequest time.Time
+
+	// Called when the screen share track ends.
+	onScreenShareStopped func(streamID string)
+
+	// Set when the user is in a room being recorded.
+	recorder *userRecorder
 
-	startVideoBrodcast chan struct{}
-	startAudioBrodcast chan struct{}
+	// Active speaker detector of the room the user is in.
+	speakers *activeSpeakerDetector
 
-	stopped bool
+	// Publishers whose video the user always receives, whatever the room
+	// Last-N.
+	pinsMutex sync.Mutex
+	pins      map[string]bool
+
+	// Stats of the tracks received from the user, by kind and layer.
+	statsMutex     sync.Mutex
+	inboundStats   map[string]*rtpStats
+	audioBytesSent uint64
+
+	// WHEP viewers watching the user.
+	viewersMutex sync.RWMutex
+	viewers      map[string]*viewer
+
+	// Kinds ("audio", "video", "screen") muted by an operator. Muted
+	// tracks are not forwarded.
+	mutedMutex sync.Mutex
+	muted      map[string]bool
+
+	// Set by stop, read by the goroutines forwarding and reporting on the
+	// user tracks. Accessed atomically.
+	stopped int32
+}
+
+// newSecret returns a random token, to resume sessions or to address the
+// WHIP and WHEP resources.
+func newSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (u *user) getConn() *websocket.Conn {
+	u.connMutex.Lock()
+	defer u.connMutex.Unlock()
+
+	return u.conn
+}
+
+func (u *user) setConn(conn *websocket.Conn) {
+	u.connMutex.Lock()
+	defer u.connMutex.Unlock()
+
+	u.conn = conn
+}
+
+// addICECandidate adds a candidate from the user, keeping it for later if
+// the remote description is not set yet.
+func (u *user) addICECandidate(c webrtc.ICECandidateInit) error {
+	u.candidatesMutex.Lock()
+	defer u.candidatesMutex.Unlock()
+
+	if u.pc.RemoteDescription() == nil {
+		if len(u.pendingCandidates) >= maxPendingCandidates {
+			return ErrTooManyCandidates
+		}
+		u.pendingCandidates = append(u.pendingCandidates, c)
+		return nil
+	}
+	return u.pc.AddICECandidate(c)
+}
+
+// flushICECandidates adds the candidates kept by addICECandidate. It is
+// called once the remote description is set.
+func (u *user) flushICECandidates() {
+	u.candidatesMutex.Lock()
+	defer u.candidatesMutex.Unlock()
+
+	for _, c := range u.pendingCandidates {
+		if err := u.pc.AddICECandidate(c); err != nil {
+			log.Printf("Error adding ICECandidate(%s): (%+v)\n", err.Error(), c)
+		}
+	}
+	u.pendingCandidates = nil
+}
+
+// canSubscribe tells whether the user receives the tracks of the room.
+func (u *user) canSubscribe() bool {
+	return !u.ingest
+}
+
+// canPublish tells whether the SFU accepts tracks from the user. In
+// webinar rooms it is the stage which decides, whatever the role.
+func (u *user) canPublish() bool {
+	if u.webinar {
+		return u.isOnStage()
+	}
+	return u.Role != roleSubscriber
 }
 
 func (u *user) stop() {
-	log.Println("User:: ", u)
-	u.stopped = true
+	log.Printf("Stopping user `%s`", u.ID)
+	atomic.StoreInt32(&u.stopped, 1)
 	if u.pc != nil {
 		u.pc.Close()
 	}
 }
 
-func (u *user) sendPLI(t *webrtc.TrackRemote) {
+func (u *user) isStopped() bool {
+	return atomic.LoadInt32(&u.stopped) == 1
+}
+
+func (u *user) sendREMB(t *webrtc.TrackRemote) {
 	ticker := time.NewTicker(3 * time.Second)
+	defer ticker.Stop()
+
 	for range ticker.C {
-		if u.stopped {
+		if u.isStopped() {
 			return
 		}
+
+		u.videoMutex.Lock()
+		current := u.videoInTracks[t.RID()] == t
+		u.videoMutex.Unlock()
+		if !current {
+			return
+		}
+
 		if u.pc.ConnectionState() != webrtc.PeerConnectionStateConnected {
 			continue
 		}
 
-		writeErr := u.pc.WriteRTCP([]rtcp.Packet{
-			&rtcp.PictureLossIndication{
-				MediaSSRC: uint32(t.SSRC()),
-			},
-		})
-		if writeErr != nil {
-			log.Println(writeErr)
-		}
 		// Send a remb message with a very high bandwidth to trigger chrome to send also the high bitrate stream
-		writeErr = u.pc.WriteRTCP([]rtcp.Packet{
+		writeErr := u.pc.WriteRTCP([]rtcp.Packet{
 			&rtcp.ReceiverEstimatedMaximumBitrate{
 				Bitrate:    10000000,
 				SenderSSRC: uint32(t.SSRC()),
@@ -81,33 +265,412 @@ func (u *user) sendPLI(t *webrtc.TrackRemote) {
 
 func (u *user) addVideoTrack(video *webrtc.TrackRemote) error {
 	u.videoMutex.Lock()
-	defer u.videoMutex.Unlock()
 
-	if u.videoInTrack != nil && u.videoOutTrack != nil {
+	layer := video.RID()
+	if _, ok := u.videoInTracks[layer]; ok {
+		u.videoMutex.Unlock()
 		return nil
 	}
 
-	go u.sendPLI(video)
+	if len(u.videoInTracks) == 0 {
+		u.videoCodec = video.Codec()
+	}
+	u.videoInTracks[layer] = video
+	u.videoMutex.Unlock()
 
-	videoTrack, err := webrtc.NewTrackLocalStaticRTP(
-		webrtc.RTPCodecCapability{
-			MimeType: video.Codec().MimeType,
+	if u.recorder != nil {
+		u.recorder.addVideoLayer(layer)
+	}
+
+	go u.sendREMB(video)
+	go u.broadcastVideo(video)
+
+	// A new layer may be a better fit for the existing subscribers.
+	u.updateSubscriberLayers()
+
+	return nil
+}
+
+// removeVideoTrack drops a layer which has ended. The video is removed
+// from the subscribers once no layer is left.
+func (u *user) removeVideoTrack(video *webrtc.TrackRemote) {
+	u.videoMutex.Lock()
+	layer := video.RID()
+	if u.videoInTracks[layer] != video {
+		u.videoMutex.Unlock()
+		return
+	}
+	delete(u.videoInTracks, layer)
+	empty := len(u.videoInTracks) == 0
+	u.videoMutex.Unlock()
+
+	u.removeInboundStats("video", video)
+
+	log.Printf("Video layer `%s` of `%s` ended", layer, u.ID)
+
+	if empty {
+		u.removeSubscriberTracks("video")
+		return
+	}
+	u.updateSubscriberLayers()
+}
+
+func (u *user) getVideoCodec() webrtc.RTPCodecParameters {
+	u.videoMutex.Lock()
+	defer u.videoMutex.Unlock()
+
+	return u.videoCodec
+}
+
+func (u *user) addViewer(v *viewer) {
+	u.viewersMutex.Lock()
+	defer u.viewersMutex.Unlock()
+
+	u.viewers[v.ID] = v
+}
+
+func (u *user) removeViewer(v *viewer) {
+	u.viewersMutex.Lock()
+	defer u.viewersMutex.Unlock()
+
+	delete(u.viewers, v.ID)
+}
+
+func (u *user) getVideoLayers() map[string]bool {
+	u.videoMutex.Lock()
+	defer u.videoMutex.Unlock()
+
+	layers := map[string]bool{}
+	for layer := range u.videoInTracks {
+		layers[layer] = true
+	}
+	return layers
+}
+
+// requestKeyframe asks the publisher for a keyframe on the given layer.
+// Requests are rate limited per layer as every subscriber may ask for one.
+func (u *user) requestKeyframe(layer string) {
+	u.videoMutex.Lock()
+	track, ok := u.videoInTracks[layer]
+	if !ok || time.Since(u.keyframeRequests[layer]) < keyframeRequestInterval {
+		u.videoMutex.Unlock()
+		return
+	}
+	u.keyframeRequests[layer] = time.Now()
+	u.videoMutex.Unlock()
+
+	u.writePLI(track)
+}
+
+func (u *user) writePLI(track *webrtc.TrackRemote) {
+	if err := u.pc.WriteRTCP([]rtcp.Packet{
+		&rtcp.PictureLossIndication{
+			MediaSSRC: uint32(track.SSRC()),
 		},
-		"video",
-		u.StreamID,
-	)
-	if err != nil {
-		log.Printf("Error: %s", err.Error())
-		return err
+	}); err != nil {
+		log.Println(err)
+	}
+}
+
+// requestRetransmission forwards a subscriber NACK to the publisher. The
+// sequence numbers are already translated to the publisher layer.
+func (u *user) requestRetransmission(layer string, sequenceNumbers []uint16) {
+	u.videoMutex.Lock()
+	track, ok := u.videoInTracks[layer]
+	u.videoMutex.Unlock()
+
+	if !ok {
+		return
+	}
+
+	u.writeNACK(track, sequenceNumbers)
+}
+
+func (u *user) writeNACK(track *webrtc.TrackRemote, sequenceNumbers []uint16) {
+	if len(sequenceNumbers) == 0 {
+		return
+	}
+
+	if err := u.pc.WriteRTCP([]rtcp.Packet{
+		&rtcp.TransportLayerNack{
+			MediaSSRC: uint32(track.SSRC()),
+			Nacks:     rtcp.NackPairsFromSequenceNumbers(sequenceNumbers),
+		},
+	}); err != nil {
+		log.Println(err)
+	}
+}
+
+// isScreenTrack tells a screen share from the camera by its stream.
+func (u *user) isScreenTrack(track *webrtc.TrackRemote) bool {
+	return track.Kind() == webrtc.RTPCodecTypeVideo && !u.ingest && u.StreamID != "" && track.StreamID() != u.StreamID
+}
+
+// addScreenTrack returns true if the screen share has started. A user can
+// only share one screen at a time.
+func (u *user) addScreenTrack(screen *webrtc.TrackRemote) bool {
+	u.screenMutex.Lock()
+	defer u.screenMutex.Unlock()
+
+	if u.screenInTrack != nil {
+		return false
+	}
+	u.screenInTrack = screen
+
+	go u.broadcastScreen(screen)
+
+	return true
+}
+
+func (u *user) removeScreenTrack(screen *webrtc.TrackRemote) {
+	u.screenMutex.Lock()
+	if u.screenInTrack != screen {
+		u.screenMutex.Unlock()
+		return
+	}
+	u.screenInTrack = nil
+	u.screenMutex.Unlock()
+
+	u.removeInboundStats("screen", screen)
+
+	log.Printf("Screen share of `%s` ended", u.ID)
+
+	u.removeSubscriberTracks("screen")
+
+	if u.onScreenShareStopped != nil {
+		u.onScreenShareStopped(screen.StreamID())
+	}
+}
+
+func (u *user) getScreenTrack() *webrtc.TrackRemote {
+	u.screenMutex.Lock()
+	defer u.screenMutex.Unlock()
+
+	return u.screenInTrack
+}
+
+func (u *user) requestScreenKeyframe() {
+	u.screenMutex.Lock()
+	screen := u.screenInTrack
+	if screen == nil || time.Since(u.screenKeyframeRequest) < screenKeyframeRequestInterval {
+		u.screenMutex.Unlock()
+		return
+	}
+	u.screenKeyframeRequest = time.Now()
+	u.screenMutex.Unlock()
+
+	u.writePLI(screen)
+}
+
+func (u *user) requestScreenRetransmission(sequenceNumbers []uint16) {
+	if screen := u.getScreenTrack(); screen != nil {
+		u.writeNACK(screen, sequenceNumbers)
+	}
+}
+
+// updateSubscriberLayer selects the layer forwarded to a subscriber and
+// requests a keyframe on it when it changes.
+func (u *user) updateSubscriberLayer(forwarder *videoForwarder) {
+	layer := forwarder.selectLayer(u.getVideoLayers())
+	if forwarder.setTargetLayer(layer) {
+		u.requestKeyframe(layer)
+	}
+}
+
+func (u *user) updateSubscriberLayers() {
+	u.subscribersMutex.RLock()
+	defer u.subscribersMutex.RUnlock()
+
+	for _, senders := range u.subscribers {
+		if senders.videoForwarder != nil {
+			u.updateSubscriberLayer(senders.videoForwarder)
+		}
 	}
+}
 
-	u.videoOutTrack = videoTrack
-	u.videoInTrack = video
-	u.startVideoBrodcast <- struct{}{}
+// setSubscriberLayer forces the layer forwarded to the subscriber.
+// `layerAuto` goes back to bandwidth based selection.
+func (u *user) setSubscriberLayer(subscriber *user, layer string) error {
+	if layer != layerAuto && !isSimulcastLayer(layer) {
+		return ErrInvalidLayer
+	}
+	if layer == layerAuto {
+		layer = ""
+	}
+
+	u.subscribersMutex.RLock()
+	senders, subscribed := u.subscribers[subscriber.ID]
+	u.subscribersMutex.RUnlock()
+
+	if !subscribed || senders.videoForwarder == nil {
+		return ErrNotSubscribed
+	}
+
+	senders.videoForwarder.setForcedLayer(layer)
+	u.updateSubscriberLayer(senders.videoForwarder)
 
 	return nil
 }
 
+// setSubscriberPaused pauses or resumes the video forwarded to the
+// subscriber. The RTPSender is kept so no renegotiation is needed.
+func (u *user) setSubscriberPaused(subscriber *user, paused bool) {
+	u.subscribersMutex.RLock()
+	senders, subscribed := u.subscribers[subscriber.ID]
+	u.subscribersMutex.RUnlock()
+
+	if !subscribed || senders.videoForwarder == nil {
+		return
+	}
+
+	if senders.videoForwarder.setPaused(paused) {
+		u.requestKeyframe(senders.videoForwarder.getTargetLayer())
+	}
+}
+
+func (u *user) isMuted(kind string) bool {
+	u.mutedMutex.Lock()
+	defer u.mutedMutex.Unlock()
+
+	return u.muted[kind]
+}
+
+// setMuted stops or resumes forwarding the given kind of track to every
+// subscriber.
+func (u *user) setMuted(kind string, muted bool) error {
+	if kind != "audio" && kind != "video" && kind != "screen" {
+		return ErrInvalidKind
+	}
+
+	u.mutedMutex.Lock()
+	u.muted[kind] = muted
+	u.mutedMutex.Unlock()
+
+	if kind == "video" && !muted {
+		// Viewers get nothing while muted and resume on a keyframe.
+		u.viewersMutex.RLock()
+		for _, v := range u.viewers {
+			v.video.restart()
+			u.requestKeyframe(v.video.getTargetLayer())
+		}
+		u.viewersMutex.RUnlock()
+	}
+
+	u.subscribersMutex.RLock()
+	defer u.subscribersMutex.RUnlock()
+
+	for _, senders := range u.subscribers {
+		if kind == "video" && senders.videoForwarder != nil {
+			if senders.videoForwarder.setMuted(muted) {
+				u.requestKeyframe(senders.videoForwarder.getTargetLayer())
+			}
+		}
+		if kind == "screen" && senders.screenForwarder != nil {
+			if senders.screenForwarder.setMuted(muted) {
+				u.requestScreenKeyframe()
+			}
+		}
+	}
+
+	return nil
+}
+
+func (u *user) setPinned(publisherID string, pinned bool) {
+	u.pinsMutex.Lock()
+	defer u.pinsMutex.Unlock()
+
+	if pinned {
+		u.pins[publisherID] = true
+		return
+	}
+	delete(u.pins, publisherID)
+}
+
+func (u *user) isPinned(publisherID string) bool {
+	u.pinsMutex.Lock()
+	defer u.pinsMutex.Unlock()
+
+	return u.pins[publisherID]
+}
+
+// readSubscriberRTCP reads the RTCP sent back by a subscriber on a video
+// sender until the sender is stopped.
+func (u *user) readSubscriberRTCP(forwarder *videoForwarder, sender *webrtc.RTPSender, screen bool) {
+	buf := make([]byte, 1500)
+	for first := true; ; first = false {
+		n, err := sender.Read(buf)
+		if err != nil {
+			return
+		}
+
+		if first {
+			// The subscriber is now receiving, get it a keyframe to start
+			// decoding straight away.
+			u.requestSubscriberKeyframe(forwarder, screen)
+		}
+
+		packets, err := rtcp.Unmarshal(buf[:n])
+		if err != nil {
+			continue
+		}
+		u.handleSubscriberRTCP(forwarder, packets, screen)
+	}
+}
+
+func (u *user) requestSubscriberKeyframe(forwarder *videoForwarder, screen bool) {
+	if screen {
+		u.requestScreenKeyframe()
+		return
+	}
+	u.requestKeyframe(forwarder.getTargetLayer())
+}
+
+// handleSubscriberRTCP relays the keyframe requests and NACKs of a
+// subscriber to the publisher.
+func (u *user) handleSubscriberRTCP(forwarder *videoForwarder, packets []rtcp.Packet, screen bool) {
+	for _, packet := range packets {
+		switch p := packet.(type) {
+		case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+			u.requestSubscriberKeyframe(forwarder, screen)
+		case *rtcp.ReceiverReport:
+			for _, report := range p.Reports {
+				forwarder.updateReceptionReport(report, time.Now())
+			}
+		case *rtcp.SenderReport:
+			// Subscribers sending media report in their sender reports.
+			for _, report := range p.Reports {
+				forwarder.updateReceptionReport(report, time.Now())
+			}
+		case *rtcp.TransportLayerNack:
+			sequenceNumbers := []uint16{}
+			for _, pair := range p.Nacks {
+				sequenceNumbers = append(sequenceNumbers, pair.PacketList()...)
+			}
+			// Answer from the forwarder buffer and only ask the publisher
+			// for what is no longer there.
+			missing := forwarder.retransmit(sequenceNumbers)
+			layer, translated := forwarder.publisherSequenceNumbers(missing)
+			if screen {
+				u.requestScreenRetransmission(translated)
+				continue
+			}
+			u.requestRetransmission(layer, translated)
+		case *rtcp.ReceiverEstimatedMaximumBitrate:
+			if screen {
+				// The screen share has a single layer.
+				continue
+			}
+			// The estimate covers every stream the subscriber receives.
+			bitrate := p.Bitrate
+			if len(p.SSRCs) > 1 {
+				bitrate = bitrate / uint64(len(p.SSRCs))
+			}
+			forwarder.setBitrate(bitrate)
+			u.updateSubscriberLayer(forwarder)
+		}
+	}
+}
+
 func (u *user) addAudioTrack(audio *webrtc.TrackRemote) error {
 	u.audioMutex.Lock()
 	defer u.audioMutex.Unlock()
@@ -116,8 +679,6 @@ func (u *user) addAudioTrack(audio *webrtc.TrackRemote) error {
 		return nil
 	}
 
-	go u.sendPLI(audio)
-
 	audioTrack, err := webrtc.NewTrackLocalStaticRTP(
 		webrtc.RTPCodecCapability{
 			MimeType: audio.Codec().MimeType,
@@ -132,88 +693,319 @@ func (u *user) addAudioTrack(audio *webrtc.TrackRemote) error {
 
 	u.audioOutTrack = audioTrack
 	u.audioInTrack = audio
-	u.startAudioBrodcast <- struct{}{}
+
+	go u.broadcastAudio(audio, audioTrack)
 
 	return nil
 }
 
-func (u *user) broadcastAudio() {
-	<-u.startAudioBrodcast
+// removeAudioTrack drops the audio once it has ended and removes it from
+// the subscribers.
+func (u *user) removeAudioTrack(audio *webrtc.TrackRemote) {
+	u.audioMutex.Lock()
+	if u.audioInTrack != audio {
+		u.audioMutex.Unlock()
+		return
+	}
+	u.audioInTrack = nil
+	u.audioOutTrack = nil
+	u.audioMutex.Unlock()
+
+	u.removeInboundStats("audio", audio)
+
+	log.Printf("Audio of `%s` ended", u.ID)
+
+	u.removeSubscriberTracks("audio")
+}
+
+// audioLevelExtensionID returns the negotiated id of the audio level
+// header extension, zero if the publisher does not send it.
+func (u *user) audioLevelExtensionID() uint8 {
+	id, audio, _ := u.mediaEngine.GetHeaderExtensionID(webrtc.RTPHeaderExtensionCapability{URI: audioLevelURI})
+	if !audio {
+		return 0
+	}
+	return uint8(id)
+}
+
+func (u *user) broadcastAudio(audio *webrtc.TrackRemote, out *webrtc.TrackLocalStaticRTP) {
+	stats := u.getInboundStats("audio", audio)
+	audioLevelID := u.audioLevelExtensionID()
+	mimeType := audio.Codec().MimeType
 	for {
-		if u.stopped {
+		if u.isStopped() {
 			return
 		}
 		// Read RTP packets being sent to Pion
-		rtp, err := u.audioInTrack.ReadRTP()
+		packet, err := audio.ReadRTP()
 		if err != nil {
 			log.Printf("Error broadcasting audio: %s\n", err.Error())
+			if !u.isStopped() {
+				u.removeAudioTrack(audio)
+			}
 			return
 		}
+		stats.update(packet, time.Now())
 
-		if writeErr := u.audioOutTrack.WriteRTP(rtp); writeErr != nil {
-			panic(writeErr)
+		if u.isMuted("audio") || !u.canPublish() {
+			continue
 		}
+
+		if u.recorder != nil {
+			u.recorder.writeRTP("audio", "", mimeType, packet)
+		}
+
+		if u.speakers != nil && audioLevelID != 0 {
+			if ext := packet.GetExtension(audioLevelID); ext != nil {
+				level := rtp.AudioLevelExtension{}
+				if err := level.Unmarshal(ext); err == nil {
+					u.speakers.observe(u.ID, level.Level)
+				}
+			}
+		}
+
+		size := packet.MarshalSize()
+		if writeErr := out.WriteRTP(packet); writeErr != nil {
+			log.Printf("Error forwarding audio: %s\n", writeErr.Error())
+		}
+
+		u.statsMutex.Lock()
+		u.audioBytesSent += uint64(size)
+		u.statsMutex.Unlock()
+
+		u.viewersMutex.RLock()
+		for _, v := range u.viewers {
+			if writeErr := v.audio.writeRTP("", packet); writeErr != nil {
+				log.Printf("Error forwarding audio: %s\n", writeErr.Error())
+			}
+		}
+		u.viewersMutex.RUnlock()
 	}
 }
 
-func (u *user) broadcastVideo() {
-	<-u.startVideoBrodcast
+func (u *user) broadcastVideo(track *webrtc.TrackRemote) {
+	stats := u.getInboundStats("video", track)
+	layer := track.RID()
+	mimeType := track.Codec().MimeType
 	for {
-		if u.stopped {
+		if u.isStopped() {
 			return
 		}
 
 		// Read RTP packets being sent to Pion
-		rtp, err := u.videoInTrack.ReadRTP()
+		rtp, err := track.ReadRTP()
 		if err != nil {
 			log.Printf("Error broadcasting video: %s\n", err.Error())
+			if !u.isStopped() {
+				u.removeVideoTrack(track)
+			}
+			return
+		}
+		stats.update(rtp, time.Now())
+
+		if !u.canPublish() {
+			continue
+		}
+
+		if u.recorder != nil {
+			u.recorder.writeRTP("video", layer, mimeType, rtp)
+		}
+
+		u.subscribersMutex.RLock()
+		for _, senders := range u.subscribers {
+			if senders.videoForwarder == nil {
+				continue
+			}
+			if writeErr := senders.videoForwarder.writeRTP(layer, rtp); writeErr != nil {
+				log.Printf("Error forwarding video: %s\n", writeErr.Error())
+			}
+		}
+		u.subscribersMutex.RUnlock()
+
+		if u.isMuted("video") {
+			continue
+		}
+		u.viewersMutex.RLock()
+		for _, v := range u.viewers {
+			if writeErr := v.video.writeRTP(layer, rtp); writeErr != nil {
+				log.Printf("Error forwarding video: %s\n", writeErr.Error())
+			}
+		}
+		u.viewersMutex.RUnlock()
+	}
+}
+
+func (u *user) broadcastScreen(screen *webrtc.TrackRemote) {
+	stats := u.getInboundStats("screen", screen)
+	layer := screen.RID()
+	for {
+		if u.isStopped() {
 			return
 		}
-		if writeErr := u.videoOutTrack.WriteRTP(rtp); writeErr != nil {
-			panic(writeErr)
+
+		rtp, err := screen.ReadRTP()
+		if err != nil {
+			log.Printf("Error broadcasting screen: %s\n", err.Error())
+			if !u.isStopped() {
+				u.removeScreenTrack(screen)
+			}
+			return
+		}
+		stats.update(rtp, time.Now())
+
+		if !u.canPublish() {
+			continue
 		}
+
+		u.subscribersMutex.RLock()
+		for _, senders := range u.subscribers {
+			if senders.screenForwarder == nil {
+				continue
+			}
+			if writeErr := senders.screenForwarder.writeRTP(layer, rtp); writeErr != nil {
+				log.Printf("Error forwarding screen: %s\n", writeErr.Error())
+			}
+		}
+		u.subscribersMutex.RUnlock()
 	}
 }
 
+// addSubscriber forwards the publisher tracks to the subscriber. It is
+// called again on every new track, only the kinds the subscriber is not
+// receiving yet are added.
 func (u *user) addSubscriber(subscriber *user) error {
-	defer log.Printf("`%s` subscribed to `%s`", subscriber.ID, u.ID)
+	if !u.canPublish() || !subscriber.canSubscribe() {
+		return nil
+	}
 
 	u.subscribersMutex.Lock()
 	defer u.subscribersMutex.Unlock()
 
-	for {
-		// Wait until tracks are set.
-		if u.videoOutTrack != nil && u.audioOutTrack != nil {
-			break
-		}
-		time.Sleep(time.Second)
+	senders, subscribed := u.subscribers[subscriber.ID]
+	if !subscribed {
+		senders = &subscriberRTPSenders{subscriber: subscriber}
 	}
 
-	if _, subscribed := u.subscribers[subscriber.ID]; subscribed {
-		// Return if already subscribed
+	u.audioMutex.Lock()
+	audioOutTrack := u.audioOutTrack
+	u.audioMutex.Unlock()
+
+	u.videoMutex.Lock()
+	videoCodec := u.videoCodec
+	hasVideo := len(u.videoInTracks) > 0
+	u.videoMutex.Unlock()
+
+	screen := u.getScreenTrack()
+
+	addAudio := senders.audioRTPSender == nil && audioOutTrack != nil
+	addVideo := senders.videoRTPSender == nil && hasVideo
+	addScreen := senders.screenRTPSender == nil && screen != nil
+	if !addAudio && !addVideo && !addScreen {
+		// Nothing new. Tracks arriving later trigger the room fan-out.
 		return nil
 	}
+	u.subscribers[subscriber.ID] = senders
 
-	// Must add the tracks to the subscriber
-	audioRTPSender, err := subscriber.pc.AddTrack(u.audioOutTrack)
-	if err != nil {
-		log.Printf("Error: %s\n", err.Error())
-		return err
+	if addAudio {
+		audioRTPSender, err := subscriber.pc.AddTrack(audioOutTrack)
+		if err != nil {
+			log.Printf("Error: %s\n", err.Error())
+			return err
+		}
+		senders.audioRTPSender = audioRTPSender
+
+		u.statsMutex.Lock()
+		senders.audioBytesStart = u.audioBytesSent
+		u.statsMutex.Unlock()
+
+		log.Printf("`%s` subscribed to `%s` audio", subscriber.ID, u.ID)
 	}
 
-	videoRTPSender, err := subscriber.pc.AddTrack(u.videoOutTrack)
-	if err != nil {
-		log.Printf("Error: %s\n", err.Error())
-		return err
+	if addVideo {
+		// Each subscriber has its own video track so it can be fed from a
+		// different simulcast layer.
+		videoForwarder, err := newVideoForwarder(videoCodec, u.StreamID)
+		if err != nil {
+			log.Printf("Error: %s\n", err.Error())
+			return err
+		}
+
+		videoRTPSender, err := subscriber.pc.AddTrack(videoForwarder.track)
+		if err != nil {
+			log.Printf("Error: %s\n", err.Error())
+			return err
+		}
+		senders.videoRTPSender = videoRTPSender
+		senders.videoForwarder = videoForwarder
+		videoForwarder.setMuted(u.isMuted("video"))
+
+		go u.readSubscriberRTCP(videoForwarder, videoRTPSender, false)
+
+		u.updateSubscriberLayer(videoForwarder)
+
+		log.Printf("`%s` subscribed to `%s` video", subscriber.ID, u.ID)
 	}
-	u.subscribers[subscriber.ID] = &subscriberRTPSenders{
-		audioRTPSender: audioRTPSender,
-		videoRTPSender: videoRTPSender,
+
+	if addScreen {
+		// The screen share is on its own stream so the subscriber can tell
+		// it from the camera. It is not subject to the room Last-N.
+		screenForwarder, err := newVideoForwarder(screen.Codec(), screen.StreamID())
+		if err != nil {
+			log.Printf("Error: %s\n", err.Error())
+			return err
+		}
+		screenForwarder.setTargetLayer(screen.RID())
+
+		screenRTPSender, err := subscriber.pc.AddTrack(screenForwarder.track)
+		if err != nil {
+			log.Printf("Error: %s\n", err.Error())
+			return err
+		}
+		senders.screenRTPSender = screenRTPSender
+		senders.screenForwarder = screenForwarder
+		screenForwarder.setMuted(u.isMuted("screen"))
+
+		go u.readSubscriberRTCP(screenForwarder, screenRTPSender, true)
+
+		log.Printf("`%s` subscribed to `%s` screen", subscriber.ID, u.ID)
 	}
 
 	return nil
 }
 
+// removeSubscriberTracks stops forwarding the tracks of the given kind,
+// "audio", "video" or "screen", to every subscriber. They renegotiate
+// without it.
+func (u *user) removeSubscriberTracks(kind string) {
+	u.subscribersMutex.Lock()
+	defer u.subscribersMutex.Unlock()
+
+	for subscriberID, senders := range u.subscribers {
+		var sender *webrtc.RTPSender
+		switch kind {
+		case "audio":
+			sender, senders.audioRTPSender = senders.audioRTPSender, nil
+		case "video":
+			sender, senders.videoRTPSender = senders.videoRTPSender, nil
+			senders.videoForwarder = nil
+		case "screen":
+			sender, senders.screenRTPSender = senders.screenRTPSender, nil
+			senders.screenForwarder = nil
+		}
+		if sender == nil {
+			continue
+		}
+
+		if err := senders.subscriber.pc.RemoveTrack(sender); err != nil {
+			log.Printf("Error: %s\n", err.Error())
+		}
+
+		if senders.audioRTPSender == nil && senders.videoRTPSender == nil && senders.screenRTPSender == nil {
+			delete(u.subscribers, subscriberID)
+		}
+	}
+}
+
 func (u *user) removeSubscriber(subscriber *user) error {
 	defer log.Printf("`%s` unsubscribed to `%s`", subscriber.ID, u.ID)
 
@@ -225,14 +1017,14 @@ func (u *user) removeSubscriber(subscriber *user) error {
 		return nil
 	}
 	theirs := u.subscribers[subscriber.ID]
-	if err := subscriber.pc.RemoveTrack(theirs.audioRTPSender); err != nil {
-		log.Printf("Error: %s\n", err.Error())
-		return err
-	}
-
-	if err := subscriber.pc.RemoveTrack(theirs.videoRTPSender); err != nil {
-		log.Printf("Error: %s\n", err.Error())
-		return err
+	for _, sender := range []*webrtc.RTPSender{theirs.audioRTPSender, theirs.videoRTPSender, theirs.screenRTPSender} {
+		if sender == nil {
+			continue
+		}
+		if err := subscriber.pc.RemoveTrack(sender); err != nil {
+			log.Printf("Error: %s\n", err.Error())
+			return err
+		}
 	}
 
 	delete(u.subscribers, subscriber.ID)
@@ -240,22 +1032,228 @@ func (u *user) removeSubscriber(subscriber *user) error {
 	return nil
 }
 
+func newTrackDetail(kind string, track *webrtc.TrackRemote) *trackDetail {
+	return &trackDetail{
+		Kind:     kind,
+		Codec:    track.Codec().MimeType,
+		Layer:    track.RID(),
+		StreamID: track.StreamID(),
+	}
+}
+
+func (u *user) getTrackDetails() []*trackDetail {
+	tracks := []*trackDetail{}
+
+	u.audioMutex.Lock()
+	if u.audioInTrack != nil {
+		tracks = append(tracks, newTrackDetail("audio", u.audioInTrack))
+	}
+	u.audioMutex.Unlock()
+
+	u.videoMutex.Lock()
+	for _, track := range u.videoInTracks {
+		tracks = append(tracks, newTrackDetail("video", track))
+	}
+	u.videoMutex.Unlock()
+
+	if screen := u.getScreenTrack(); screen != nil {
+		tracks = append(tracks, newTrackDetail("screen", screen))
+	}
+
+	return tracks
+}
+
+// getDetail describes the user for the operators.
+func (u *user) getDetail() *participantDetail {
+	u.subscribersMutex.RLock()
+	subscribers := len(u.subscribers)
+	u.subscribersMutex.RUnlock()
+
+	return &participantDetail{
+		ID:          u.ID,
+		Username:    u.Username,
+		StreamID:    u.StreamID,
+		JoinedAt:    u.joinedAt,
+		Tracks:      u.getTrackDetails(),
+		Subscribers: subscribers,
+		ICEState:    u.pc.ICEConnectionState().String(),
+		DTLSState:   u.pc.SCTP().Transport().State().String(),
+		Audience:    u.webinar && !u.isOnStage(),
+	}
+}
+
+func inboundStatsKey(kind string, track *webrtc.TrackRemote) string {
+	return kind + "/" + track.RID()
+}
+
+func (u *user) getInboundStats(kind string, track *webrtc.TrackRemote) *rtpStats {
+	u.statsMutex.Lock()
+	defer u.statsMutex.Unlock()
+
+	key := inboundStatsKey(kind, track)
+	if _, ok := u.inboundStats[key]; !ok {
+		u.inboundStats[key] = newRTPStats(kind, track.RID(), track.Codec().ClockRate)
+	}
+	return u.inboundStats[key]
+}
+
+func (u *user) removeInboundStats(kind string, track *webrtc.TrackRemote) {
+	u.statsMutex.Lock()
+	defer u.statsMutex.Unlock()
+
+	delete(u.inboundStats, inboundStatsKey(kind, track))
+}
+
+// readPublisherRTCP reads the RTCP sent by the publisher along with a
+// track, the sender reports are needed to report back to it.
+func (u *user) readPublisherRTCP(kind string, track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	stats := u.getInboundStats(kind, track)
+	for {
+		var packets []rtcp.Packet
+		var err error
+		if track.RID() != "" {
+			packets, err = receiver.ReadSimulcastRTCP(track.RID())
+		} else {
+			packets, err = receiver.ReadRTCP()
+		}
+		if err != nil {
+			return
+		}
+
+		for _, packet := range packets {
+			if sr, ok := packet.(*rtcp.SenderReport); ok && sr.SSRC == uint32(track.SSRC()) {
+				stats.updateSenderReport(sr, time.Now())
+			}
+		}
+	}
+}
+
+// sendReports sends receiver reports on the user tracks to the user and
+// sender reports on the forwarded video to the subscribers.
+func (u *user) sendReports() {
+	ticker := time.NewTicker(rtcpReportInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		if u.isStopped() {
+			return
+		}
+		if u.pc.ConnectionState() != webrtc.PeerConnectionStateConnected {
+			continue
+		}
+
+		u.statsMutex.Lock()
+		reports := []rtcp.ReceptionReport{}
+		for _, stats := range u.inboundStats {
+			if report, ok := stats.receptionReport(now); ok {
+				reports = append(reports, report)
+			}
+		}
+		u.statsMutex.Unlock()
+
+		if len(reports) > 0 {
+			if err := u.pc.WriteRTCP([]rtcp.Packet{
+				&rtcp.ReceiverReport{
+					SSRC:    rtcpSenderSSRC,
+					Reports: reports,
+				},
+			}); err != nil {
+				log.Println(err)
+			}
+		}
+
+		u.subscribersMutex.RLock()
+		for _, senders := range u.subscribers {
+			for _, forwarder := range []*videoForwarder{senders.videoForwarder, senders.screenForwarder} {
+				if forwarder == nil {
+					continue
+				}
+				if report, ok := forwarder.senderReport(now); ok {
+					if err := senders.subscriber.pc.WriteRTCP([]rtcp.Packet{report}); err != nil {
+						log.Println(err)
+					}
+				}
+			}
+		}
+		u.subscribersMutex.RUnlock()
+	}
+}
+
+func (u *user) getStats() *userStats {
+	stats := &userStats{
+		ID:          u.ID,
+		Username:    u.Username,
+		Inbound:     []*streamStats{},
+		Subscribers: []*subscriberStats{},
+	}
+
+	u.statsMutex.Lock()
+	for _, inbound := range u.inboundStats {
+		stats.Inbound = append(stats.Inbound, inbound.getStats())
+	}
+	audioBytesSent := u.audioBytesSent
+	u.statsMutex.Unlock()
+
+	u.subscribersMutex.RLock()
+	defer u.subscribersMutex.RUnlock()
+
+	for subscriberID, senders := range u.subscribers {
+		ss := &subscriberStats{SubscriberID: subscriberID}
+		if senders.audioRTPSender != nil {
+			ss.BytesSent += audioBytesSent - senders.audioBytesStart
+		}
+		if senders.screenForwarder != nil {
+			ss.BytesSent += senders.screenForwarder.getStats().BytesSent
+		}
+		if senders.videoForwarder != nil {
+			video := senders.videoForwarder.getStats()
+			ss.BytesSent += video.BytesSent
+			ss.VideoLayer = video.Layer
+			ss.PacketsLost = video.PacketsLost
+			ss.FractionLost = video.FractionLost
+			ss.Jitter = video.Jitter
+			ss.RTT = video.RTT
+		}
+		stats.Subscribers = append(stats.Subscribers, ss)
+	}
+
+	return stats
+}
+
 func (u *user) showSubscribers() {
 	ticker := time.NewTicker(5 * time.Second)
 
 	for range ticker.C {
-		if u.stopped {
+		if u.isStopped() {
 			return
 		}
 
 		log.Printf("User: %s, subscribers: %d, senders: %d", u.ID, len(u.subscribers), len(u.pc.GetSenders()))
+
+		u.subscribersMutex.RLock()
+		for subscriberID, senders := range u.subscribers {
+			if senders.videoForwarder == nil {
+				continue
+			}
+			log.Printf("User: %s, subscriber: %s, video: %+v", u.ID, subscriberID, senders.videoForwarder.getStats())
+		}
+		u.subscribersMutex.RUnlock()
 	}
 }
 
-func (s *userFactory) newPeerConnection() (*webrtc.PeerConnection, error) {
-	me, err := getPublisherMediaEngine()
-	if err != nil {
-		return nil, err
+func (s *userFactory) newPeerConnection(me *webrtc.MediaEngine) (*webrtc.PeerConnection, error) {
+	iceServers := []webrtc.ICEServer{}
+	if s.cfg.StunServerAddr != "" {
+		iceServers = append(iceServers, webrtc.ICEServer{
+			URLs: []string{s.cfg.StunServerAddr},
+		})
+	}
+	if s.cfg.TurnServerAddr != "" {
+		iceServers = append(iceServers, webrtc.ICEServer{
+			URLs:       []string{s.cfg.TurnServerAddr},
+			Credential: "thiskey",
+			Username:   "thisuser",
+		})
 	}
 
 	return webrtc.NewAPI(webrtc.WithMediaEngine(me)).
@@ -263,16 +1261,7 @@ func (s *userFactory) newPeerConnection() (*webrtc.PeerConnection, error) {
 		NewPeerConnection(webrtc.Configuration{
 			SDPSemantics: webrtc.SDPSemanticsUnifiedPlanWithFallback,
 			//ICETransportPolicy: webrtc.ICETransportPolicyRelay,
-			ICEServers: []webrtc.ICEServer{
-				{
-					URLs: []string{"stun:stun.l.google.com:19302"},
-				},
-				{
-					URLs:       []string{s.cfg.TurnServerAddr},
-					Credential: "thiskey",
-					Username:   "thisuser",
-				},
-			},
+			ICEServers: iceServers,
 		})
 }
 
@@ -281,7 +1270,13 @@ type userFactory struct {
 }
 
 func (f *userFactory) newUser(u *user) (*user, error) {
-	pc, err := f.newPeerConnection()
+	me, err := getPublisherMediaEngine()
+	if err != nil {
+		log.Print("Error creating media engine: ", err.Error())
+		return nil, err
+	}
+
+	pc, err := f.newPeerConnection(me)
 	if err != nil {
 		log.Print("Error creating Peer connection: ", err.Error())
 		return nil, err
@@ -291,19 +1286,23 @@ func (f *userFactory) newUser(u *user) (*user, error) {
 		ID:       u.ID,
 		Username: u.Username,
 		StreamID: u.StreamID,
+		Role:     u.Role,
 
 		pc:               pc,
+		mediaEngine:      me,
+		negotiation:      newNegotiationQueue(),
 		subscribersMutex: sync.RWMutex{},
 		subscribers:      map[string]*subscriberRTPSenders{},
 
-		startVideoBrodcast: make(chan struct{}),
-		startAudioBrodcast: make(chan struct{}),
-
-		stopped: false,
+		videoInTracks:    map[string]*webrtc.TrackRemote{},
+		keyframeRequests: map[string]time.Time{},
+		pins:             map[string]bool{},
+		muted:            map[string]bool{},
+		viewers:          map[string]*viewer{},
+		inboundStats:     map[string]*rtpStats{},
 	}
 
-	go newUser.broadcastAudio()
-	go newUser.broadcastVideo()
+	go newUser.sendReports()
 
 	// go newUser.showSubscribers()
 
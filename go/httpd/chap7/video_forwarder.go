@@ -0,0 +1,366 @@
+package chap7
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// videoForwarder forwards a single layer of a publisher video to one
+// subscriber.
+// Sequence numbers and timestamps are rewritten so the subscriber sees a
+// continuous stream when the forwarded layer changes.
+type videoForwarder struct {
+	mutex sync.Mutex
+
+	track    *webrtc.TrackLocalStaticRTP
+	mimeType string
+
+	// Layer being forwarded and the layer we want to switch to. Switching
+	// only happens on a keyframe of the target layer.
+	currentLayer string
+	targetLayer  string
+
+	// Layer requested by the subscriber. Empty means automatic selection.
+	forcedLayer string
+	// Bandwidth estimate (bps) from the subscriber REMB.
+	bitrate uint64
+
+	// Paused (Last-N) or muted (moderation) forwarders drop every packet.
+	// On resume, forwarding restarts from a keyframe.
+	paused   bool
+	muted    bool
+	resuming bool
+
+	started       bool
+	lastSeq       uint16
+	lastTimestamp uint32
+	lastWrite     time.Time
+	seqOffset     uint16
+	tsOffset      uint32
+	clockRate     uint32
+
+	// Packets sent to the subscriber, used to answer its NACKs.
+	buffer     packetBuffer
+	nackHits   uint64
+	nackMisses uint64
+
+	// SSRC the subscriber receives the track on, known once a packet is
+	// written.
+	ssrc        uint32
+	packetsSent uint32
+	bytesSent   uint64
+
+	// From the subscriber receiver reports.
+	fractionLost uint8
+	packetsLost  uint32
+	jitter       uint32
+	rtt          time.Duration
+}
+
+type videoForwarderStats struct {
+	Layer      string `json:"layer"`
+	Paused     bool   `json:"paused"`
+	Bitrate    uint64 `json:"bitrate"`
+	NackHits   uint64 `json:"nackHits"`
+	NackMisses uint64 `json:"nackMisses"`
+	BytesSent  uint64 `json:"bytesSent"`
+
+	PacketsLost  uint32  `json:"packetsLost"`
+	FractionLost float64 `json:"fractionLost"`
+	// Milliseconds
+	Jitter float64 `json:"jitter"`
+	RTT    float64 `json:"rtt"`
+}
+
+func (f *videoForwarder) getStats() videoForwarderStats {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return videoForwarderStats{
+		Layer:      f.currentLayer,
+		Paused:     f.paused,
+		Bitrate:    f.bitrate,
+		NackHits:   f.nackHits,
+		NackMisses: f.nackMisses,
+		BytesSent:  f.bytesSent,
+
+		PacketsLost:  f.packetsLost,
+		FractionLost: float64(f.fractionLost) / 256,
+		Jitter:       float64(f.jitter) * 1000 / float64(f.clockRate),
+		RTT:          float64(f.rtt) / float64(time.Millisecond),
+	}
+}
+
+// senderReport returns the RTCP sender report of the track, false if
+// nothing was sent yet.
+func (f *videoForwarder) senderReport(now time.Time) (*rtcp.SenderReport, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if !f.started || f.ssrc == 0 {
+		return nil, false
+	}
+
+	elapsed := uint32(now.Sub(f.lastWrite) * time.Duration(f.clockRate) / time.Second)
+	return &rtcp.SenderReport{
+		SSRC:        f.ssrc,
+		NTPTime:     ntpTime(now),
+		RTPTime:     f.lastTimestamp + elapsed,
+		PacketCount: f.packetsSent,
+		OctetCount:  uint32(f.bytesSent),
+	}, true
+}
+
+// updateReceptionReport takes the subscriber report on the track. The
+// RTT is known once the subscriber has seen a sender report.
+func (f *videoForwarder) updateReceptionReport(report rtcp.ReceptionReport, now time.Time) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if report.SSRC != f.ssrc {
+		return
+	}
+
+	f.fractionLost = report.FractionLost
+	f.packetsLost = report.TotalLost
+	f.jitter = report.Jitter
+
+	if report.LastSenderReport != 0 {
+		rtt := ntpMiddle(now) - report.LastSenderReport - report.Delay
+		f.rtt = time.Duration(rtt) * time.Second / 65536
+	}
+}
+
+func (f *videoForwarder) setForcedLayer(layer string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.forcedLayer = layer
+}
+
+func (f *videoForwarder) setBitrate(bitrate uint64) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	// Smooth the estimate so the layer does not flap on every REMB.
+	if f.bitrate == 0 {
+		f.bitrate = bitrate
+		return
+	}
+	f.bitrate = (f.bitrate*7 + bitrate*3) / 10
+}
+
+// selectLayer returns the best layer for the subscriber out of the
+// `available` publisher layers.
+func (f *videoForwarder) selectLayer(available map[string]bool) string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return selectLayer(available, f.forcedLayer, f.bitrate)
+}
+
+func (f *videoForwarder) getTargetLayer() string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.targetLayer
+}
+
+// publisherSequenceNumbers translates sequence numbers sent to the
+// subscriber back to the ones of the layer being forwarded.
+func (f *videoForwarder) publisherSequenceNumbers(sequenceNumbers []uint16) (string, []uint16) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	translated := make([]uint16, len(sequenceNumbers))
+	for i, sequenceNumber := range sequenceNumbers {
+		translated[i] = sequenceNumber + f.seqOffset
+	}
+	return f.currentLayer, translated
+}
+
+// setPaused returns true if the forwarder has resumed, so a keyframe is
+// needed.
+func (f *videoForwarder) setPaused(paused bool) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	blocked := f.paused || f.muted
+	f.paused = paused
+	return f.checkResumed(blocked)
+}
+
+// setMuted returns true if the forwarder has resumed, so a keyframe is
+// needed.
+func (f *videoForwarder) setMuted(muted bool) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	blocked := f.paused || f.muted
+	f.muted = muted
+	return f.checkResumed(blocked)
+}
+
+func (f *videoForwarder) checkResumed(wasBlocked bool) bool {
+	if !wasBlocked || f.paused || f.muted {
+		return false
+	}
+	f.resuming = true
+	return true
+}
+
+// restart makes the forwarder wait for a keyframe and continue the
+// sequence from it, as when its source changes.
+func (f *videoForwarder) restart() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.started {
+		f.resuming = true
+	}
+}
+
+// setTargetLayer returns true if the target layer has changed.
+func (f *videoForwarder) setTargetLayer(layer string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.targetLayer == layer {
+		return false
+	}
+	f.targetLayer = layer
+	return true
+}
+
+func (f *videoForwarder) writeRTP(layer string, packet *rtp.Packet) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	switch {
+	case f.paused || f.muted:
+		return nil
+	case (!f.started || f.resuming) && layer == f.targetLayer:
+		// Nothing can be decoded before the first keyframe.
+		if !isKeyframe(f.mimeType, packet.Payload) {
+			return nil
+		}
+		f.resuming = false
+		f.switchLayer(layer, packet)
+	case f.resuming:
+		return nil
+	case layer == f.currentLayer && f.currentLayer == f.targetLayer:
+	case layer == f.targetLayer:
+		if !isKeyframe(f.mimeType, packet.Payload) {
+			return nil
+		}
+		f.switchLayer(layer, packet)
+	case layer == f.currentLayer:
+		// Keep forwarding the current layer until the switch happens.
+	default:
+		return nil
+	}
+
+	out := &rtp.Packet{
+		Header:  packet.Header,
+		Payload: packet.Payload,
+	}
+	// Header extensions are negotiated per PeerConnection, the ids from the
+	// publisher are meaningless for the subscriber.
+	out.Header.Extension = false
+	out.Header.Extensions = nil
+	out.Header.SequenceNumber = packet.SequenceNumber - f.seqOffset
+	out.Header.Timestamp = packet.Timestamp - f.tsOffset
+
+	if !f.started || int16(out.SequenceNumber-f.lastSeq) > 0 {
+		f.lastSeq = out.SequenceNumber
+		f.lastTimestamp = out.Timestamp
+		f.lastWrite = time.Now()
+	}
+	f.started = true
+	f.buffer.push(out)
+
+	if err := f.track.WriteRTP(out); err != nil {
+		return err
+	}
+
+	// The track sets the SSRC of the subscriber binding on the packet,
+	// it is left as is while the track is not bound.
+	if out.SSRC != packet.SSRC {
+		f.ssrc = out.SSRC
+	}
+	f.packetsSent++
+	f.bytesSent += uint64(out.MarshalSize())
+	return nil
+}
+
+// retransmit resends the packets still in the buffer and returns the
+// sequence numbers which are not.
+// Packets are resent as they were sent, on the media SSRC. RTX is out of
+// scope: pion signals a single SSRC for the tracks the SFU sends, with no
+// repair flow the subscriber could map RTX packets to.
+func (f *videoForwarder) retransmit(sequenceNumbers []uint16) []uint16 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	missing := []uint16{}
+	for _, sequenceNumber := range sequenceNumbers {
+		packet := f.buffer.get(sequenceNumber)
+		if packet == nil {
+			f.nackMisses++
+			missing = append(missing, sequenceNumber)
+			continue
+		}
+
+		f.nackHits++
+		if err := f.track.WriteRTP(packet); err != nil {
+			log.Printf("Error retransmitting packet: %s\n", err.Error())
+		}
+	}
+	return missing
+}
+
+// switchLayer starts forwarding `layer` from its keyframe `packet`.
+func (f *videoForwarder) switchLayer(layer string, packet *rtp.Packet) {
+	f.currentLayer = layer
+	if !f.started {
+		return
+	}
+
+	// Continue the sequence right after the last packet sent and move the
+	// timestamp by the time elapsed since then.
+	elapsed := uint32(time.Since(f.lastWrite).Milliseconds()) * (f.clockRate / 1000)
+	if elapsed == 0 {
+		elapsed = 1
+	}
+	f.seqOffset = packet.SequenceNumber - (f.lastSeq + 1)
+	f.tsOffset = packet.Timestamp - (f.lastTimestamp + elapsed)
+}
+
+func newVideoForwarder(codec webrtc.RTPCodecParameters, streamID string) (*videoForwarder, error) {
+	track, err := webrtc.NewTrackLocalStaticRTP(
+		webrtc.RTPCodecCapability{
+			MimeType: codec.MimeType,
+		},
+		"video",
+		streamID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	clockRate := codec.ClockRate
+	if clockRate == 0 {
+		clockRate = 90000
+	}
+
+	return &videoForwarder{
+		track:     track,
+		mimeType:  codec.MimeType,
+		clockRate: clockRate,
+	}, nil
+}
@@ -0,0 +1,68 @@
+package chap7
+
+import (
+	"testing"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVideoForwarder_retransmit(t *testing.T) {
+	f, err := newVideoForwarder(webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypeVP8}}, "stream")
+	assert.Nil(t, err)
+
+	// A VP8 keyframe starts the forwarding.
+	keyframe := []byte{0x10, 0x10, 0x02, 0x00, 0x9d, 0x01, 0x2a}
+	for seq := uint16(10); seq < 15; seq++ {
+		assert.Nil(t, f.writeRTP("", &rtp.Packet{Header: rtp.Header{SequenceNumber: seq}, Payload: keyframe}))
+	}
+
+	assert.Equal(t, []uint16{9, 15}, f.retransmit([]uint16{9, 10, 14, 15}))
+
+	stats := f.getStats()
+	assert.Equal(t, uint64(2), stats.NackHits)
+	assert.Equal(t, uint64(2), stats.NackMisses)
+}
+
+func TestUser_handleSubscriberRTCP(t *testing.T) {
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	assert.Nil(t, err)
+	defer pc.Close()
+
+	publisher := newTestPublisher("a", mimeTypeVP8)
+	publisher.pc = pc
+	publisher.videoInTracks[""] = &webrtc.TrackRemote{}
+	publisher.screenInTrack = &webrtc.TrackRemote{}
+
+	f, err := newVideoForwarder(publisher.videoCodec, "stream")
+	assert.Nil(t, err)
+
+	keyframe := []byte{0x10, 0x10, 0x02, 0x00, 0x9d, 0x01, 0x2a}
+	for seq := uint16(10); seq < 15; seq++ {
+		assert.Nil(t, f.writeRTP("", &rtp.Packet{Header: rtp.Header{SequenceNumber: seq}, Payload: keyframe}))
+	}
+
+	// A PLI turns into a keyframe request to the publisher, the ones
+	// following too soon are dropped.
+	publisher.handleSubscriberRTCP(f, []rtcp.Packet{&rtcp.PictureLossIndication{}}, false)
+	requested := publisher.keyframeRequests[""]
+	assert.False(t, requested.IsZero())
+
+	publisher.handleSubscriberRTCP(f, []rtcp.Packet{&rtcp.FullIntraRequest{}}, false)
+	assert.Equal(t, requested, publisher.keyframeRequests[""])
+
+	// Screen share keyframes are requested on their own.
+	publisher.handleSubscriberRTCP(f, []rtcp.Packet{&rtcp.PictureLossIndication{}}, true)
+	assert.False(t, publisher.screenKeyframeRequest.IsZero())
+
+	// NACKs are answered from the forwarder buffer, the rest is asked to
+	// the publisher.
+	publisher.handleSubscriberRTCP(f, []rtcp.Packet{&rtcp.TransportLayerNack{
+		Nacks: rtcp.NackPairsFromSequenceNumbers([]uint16{12, 13, 20}),
+	}}, false)
+	stats := f.getStats()
+	assert.Equal(t, uint64(2), stats.NackHits)
+	assert.Equal(t, uint64(1), stats.NackMisses)
+}
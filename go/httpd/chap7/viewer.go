@@ -0,0 +1,257 @@
+package chap7
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+var ErrViewerNotFound = errors.New("Viewer not found")
+
+// viewer is a WHEP receive-only peer fed with the video and audio of one
+// publisher of the room. Viewers are not room users: they do not count
+// toward the capacity and the room is not told about them.
+type viewer struct {
+	ID string
+	pc *webrtc.PeerConnection
+
+	// Viewers created without a publisher follow the active speaker.
+	followSpeaker bool
+
+	publisherMutex sync.Mutex
+	publisher      *user
+
+	// The viewer tracks are negotiated once, switching publisher only
+	// changes what is written to them.
+	video *videoForwarder
+	audio *videoForwarder
+}
+
+func (v *viewer) getPublisher() *user {
+	v.publisherMutex.Lock()
+	defer v.publisherMutex.Unlock()
+
+	return v.publisher
+}
+
+// setPublisher feeds the viewer from `publisher`. Forwarding restarts on
+// its next keyframe, continuing the sequence the viewer receives. It
+// returns false if the publisher video codec is not the one negotiated.
+func (v *viewer) setPublisher(publisher *user) bool {
+	codec := publisher.getVideoCodec()
+	if !strings.EqualFold(codec.MimeType, v.video.mimeType) {
+		return false
+	}
+
+	v.publisherMutex.Lock()
+	old := v.publisher
+	v.publisher = publisher
+	v.publisherMutex.Unlock()
+
+	if old == publisher {
+		return true
+	}
+	if old != nil {
+		old.removeViewer(v)
+	}
+
+	v.video.restart()
+	v.audio.restart()
+	publisher.addViewer(v)
+
+	publisher.updateSubscriberLayer(v.video)
+	publisher.requestKeyframe(v.video.getTargetLayer())
+
+	log.Printf("Viewer `%s` watching `%s`", v.ID, publisher.ID)
+	return true
+}
+
+// readRTCP handles the viewer feedback on its video, on behalf of the
+// publisher it is watching.
+func (v *viewer) readRTCP(sender *webrtc.RTPSender) {
+	buf := make([]byte, 1500)
+	for {
+		n, err := sender.Read(buf)
+		if err != nil {
+			return
+		}
+
+		packets, err := rtcp.Unmarshal(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		publisher := v.getPublisher()
+		if publisher == nil {
+			continue
+		}
+
+		for _, packet := range packets {
+			switch p := packet.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				publisher.requestKeyframe(v.video.getTargetLayer())
+			case *rtcp.ReceiverReport:
+				for _, report := range p.Reports {
+					v.video.updateReceptionReport(report, time.Now())
+				}
+			case *rtcp.TransportLayerNack:
+				sequenceNumbers := []uint16{}
+				for _, pair := range p.Nacks {
+					sequenceNumbers = append(sequenceNumbers, pair.PacketList()...)
+				}
+				missing := v.video.retransmit(sequenceNumbers)
+				layer, translated := v.video.publisherSequenceNumbers(missing)
+				publisher.requestRetransmission(layer, translated)
+			case *rtcp.ReceiverEstimatedMaximumBitrate:
+				v.video.setBitrate(p.Bitrate)
+				publisher.updateSubscriberLayer(v.video)
+			}
+		}
+	}
+}
+
+func (v *viewer) close() {
+	if publisher := v.getPublisher(); publisher != nil {
+		publisher.removeViewer(v)
+	}
+	if err := v.pc.Close(); err != nil {
+		log.Print("Error: ", err.Error())
+	}
+}
+
+// newAudioForwarder returns a forwarder for Opus audio. Every audio packet
+// decodes on its own, so it switches source on any packet.
+func newAudioForwarder(streamID string) (*videoForwarder, error) {
+	track, err := webrtc.NewTrackLocalStaticRTP(
+		webrtc.RTPCodecCapability{
+			MimeType: mimeTypeOpus,
+		},
+		"audio",
+		streamID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &videoForwarder{
+		track:     track,
+		mimeType:  mimeTypeOpus,
+		clockRate: 48000,
+	}, nil
+}
+
+// newViewer creates a viewer watching `publisher`. Its tracks are added
+// before the viewer offer is set so they are matched to its m-lines.
+func newViewer(id string, pc *webrtc.PeerConnection, publisher *user) (*viewer, error) {
+	video, err := newVideoForwarder(publisher.getVideoCodec(), id)
+	if err != nil {
+		return nil, err
+	}
+	audio, err := newAudioForwarder(id)
+	if err != nil {
+		return nil, err
+	}
+
+	sendonly := webrtc.RtpTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly}
+	videoTransceiver, err := pc.AddTransceiverFromTrack(video.track, sendonly)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := pc.AddTransceiverFromTrack(audio.track, sendonly); err != nil {
+		return nil, err
+	}
+
+	v := &viewer{
+		ID:    id,
+		pc:    pc,
+		video: video,
+		audio: audio,
+	}
+	go v.readRTCP(videoTransceiver.Sender())
+
+	return v, nil
+}
+
+func (r *room) addViewer(v *viewer) {
+	r.viewersMutex.Lock()
+	defer r.viewersMutex.Unlock()
+
+	r.viewers[v.ID] = v
+}
+
+func (r *room) removeViewer(id string) *viewer {
+	r.viewersMutex.Lock()
+	defer r.viewersMutex.Unlock()
+
+	v := r.viewers[id]
+	delete(r.viewers, id)
+	return v
+}
+
+func (r *room) getViewer(id string) *viewer {
+	r.viewersMutex.Lock()
+	defer r.viewersMutex.Unlock()
+
+	return r.viewers[id]
+}
+
+func (r *room) getViewers() []*viewer {
+	r.viewersMutex.Lock()
+	defer r.viewersMutex.Unlock()
+
+	viewers := []*viewer{}
+	for _, v := range r.viewers {
+		viewers = append(viewers, v)
+	}
+	return viewers
+}
+
+// defaultPublisher returns the most recent speaker with a video, nil if
+// nobody in the room publishes one.
+func (r *room) defaultPublisher() *user {
+	r.speakerOrderMutex.Lock()
+	order := append([]string{}, r.speakerOrder...)
+	r.speakerOrderMutex.Unlock()
+
+	for _, id := range order {
+		if user := r.getUserByID(id); user != nil && user.canPublish() && len(user.getVideoLayers()) > 0 {
+			return user
+		}
+	}
+	return nil
+}
+
+// followSpeaker moves the viewers following the active speaker to it.
+func (r *room) followSpeaker(speaker *user) {
+	if len(speaker.getVideoLayers()) == 0 {
+		return
+	}
+	for _, v := range r.getViewers() {
+		if v.followSpeaker {
+			v.setPublisher(speaker)
+		}
+	}
+}
+
+// reassignViewers finds the viewers of a publisher which left another
+// publisher to follow. Viewers of that publisher only are closed.
+func (r *room) reassignViewers(publisher *user) {
+	for _, v := range r.getViewers() {
+		if v.getPublisher() != publisher {
+			continue
+		}
+		if !v.followSpeaker {
+			r.removeViewer(v.ID)
+			v.close()
+			continue
+		}
+		if next := r.defaultPublisher(); next != nil {
+			v.setPublisher(next)
+		}
+	}
+}
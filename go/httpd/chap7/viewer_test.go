@@ -0,0 +1,79 @@
+package chap7
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestPublisher(id, mimeType string) *user {
+	return &user{
+		ID:               id,
+		videoCodec:       webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeType}},
+		videoInTracks:    map[string]*webrtc.TrackRemote{},
+		keyframeRequests: map[string]time.Time{},
+		viewers:          map[string]*viewer{},
+	}
+}
+
+func newTestViewer(t *testing.T, id string, publisher *user) *viewer {
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	assert.Nil(t, err)
+
+	v, err := newViewer(id, pc, publisher)
+	assert.Nil(t, err)
+	return v
+}
+
+func TestViewer_setPublisher(t *testing.T) {
+	a := newTestPublisher("a", mimeTypeVP8)
+	b := newTestPublisher("b", mimeTypeVP8)
+	c := newTestPublisher("c", mimeTypeH264)
+
+	v := newTestViewer(t, "viewer", a)
+	defer v.close()
+
+	assert.True(t, v.setPublisher(a))
+	assert.Equal(t, a, v.getPublisher())
+	assert.Len(t, a.viewers, 1)
+
+	assert.True(t, v.setPublisher(b))
+	assert.Equal(t, b, v.getPublisher())
+	assert.Len(t, a.viewers, 0)
+	assert.Len(t, b.viewers, 1)
+
+	// The viewer tracks were negotiated for VP8.
+	assert.False(t, v.setPublisher(c))
+	assert.Equal(t, b, v.getPublisher())
+	assert.Len(t, c.viewers, 0)
+}
+
+func TestWHEP_deleteResource(t *testing.T) {
+	s := newTestHandler()
+	m := mux.NewRouter()
+	s.RegisterHandlers(m, nil)
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+
+	r := s.roomFactory.getOrCreate("room", roomSettings{})
+	publisher := newTestPublisher("a", mimeTypeVP8)
+	v := newTestViewer(t, "secret", publisher)
+	r.addViewer(v)
+	v.setPublisher(publisher)
+
+	res := sendWHIPRequest(t, http.MethodDelete, srv.URL+"/whep/room/"+publisher.ID, "")
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	res = sendWHIPRequest(t, http.MethodDelete, srv.URL+"/whep/room/secret", "")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Nil(t, r.getViewer("secret"))
+	assert.Len(t, publisher.viewers, 0)
+
+	res = sendWHIPRequest(t, http.MethodDelete, srv.URL+"/whep/room/secret", "")
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
@@ -0,0 +1,334 @@
+package chap7
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"sort"
+)
+
+// Matroska element ids used by the writer.
+const (
+	ebmlIDHeader             = 0x1A45DFA3
+	ebmlIDVersion            = 0x4286
+	ebmlIDReadVersion        = 0x42F7
+	ebmlIDMaxIDLength        = 0x42F2
+	ebmlIDMaxSizeLength      = 0x42F3
+	ebmlIDDocType            = 0x4282
+	ebmlIDDocTypeVersion     = 0x4287
+	ebmlIDDocTypeReadVersion = 0x4285
+
+	mkvIDSegment           = 0x18538067
+	mkvIDInfo              = 0x1549A966
+	mkvIDTimecodeScale     = 0x2AD7B1
+	mkvIDMuxingApp         = 0x4D80
+	mkvIDWritingApp        = 0x5741
+	mkvIDTracks            = 0x1654AE6B
+	mkvIDTrackEntry        = 0xAE
+	mkvIDTrackNumber       = 0xD7
+	mkvIDTrackUID          = 0x73C5
+	mkvIDTrackType         = 0x83
+	mkvIDCodecID           = 0x86
+	mkvIDCodecPrivate      = 0x63A2
+	mkvIDVideo             = 0xE0
+	mkvIDPixelWidth        = 0xB0
+	mkvIDPixelHeight       = 0xBA
+	mkvIDAudio             = 0xE1
+	mkvIDSamplingFrequency = 0xB5
+	mkvIDChannels          = 0x9F
+	mkvIDCluster           = 0x1F43B675
+	mkvIDTimecode          = 0xE7
+	mkvIDSimpleBlock       = 0xA3
+
+	mkvTrackTypeVideo = 1
+	mkvTrackTypeAudio = 2
+)
+
+const (
+	// Clusters are written whole, this is the most a crash can lose.
+	webmClusterDuration = 5000
+	// How long (ms) frames are held waiting for every track to show up
+	// before the header is written.
+	webmHeaderTimeout = 3000
+)
+
+// Unknown size, used for the segment as it is written as a stream.
+var ebmlUnknownSize = []byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+
+func ebmlID(id uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, id)
+	for len(b) > 1 && b[0] == 0 {
+		b = b[1:]
+	}
+	return b
+}
+
+func ebmlSize(size uint64) []byte {
+	length := 1
+	for length < 8 && size >= (uint64(1)<<(7*uint(length)))-1 {
+		length++
+	}
+
+	b := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		b[i] = byte(size)
+		size >>= 8
+	}
+	b[0] |= 0x80 >> uint(length-1)
+	return b
+}
+
+func ebmlElement(id uint32, data []byte) []byte {
+	b := append(ebmlID(id), ebmlSize(uint64(len(data)))...)
+	return append(b, data...)
+}
+
+func ebmlMaster(id uint32, children ...[]byte) []byte {
+	return ebmlElement(id, bytes.Join(children, nil))
+}
+
+func ebmlUint(id uint32, value uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, value)
+	for len(b) > 1 && b[0] == 0 {
+		b = b[1:]
+	}
+	return ebmlElement(id, b)
+}
+
+func ebmlFloat(id uint32, value float64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, math.Float64bits(value))
+	return ebmlElement(id, b)
+}
+
+func ebmlString(id uint32, value string) []byte {
+	return ebmlElement(id, []byte(value))
+}
+
+// opusHead is the CodecPrivate of an Opus track.
+func opusHead(channels uint8, sampleRate uint32) []byte {
+	b := []byte("OpusHead")
+	b = append(b, 1, channels)
+	b = append(b, 0x38, 0x01) // Pre skip of 312 samples
+	sr := make([]byte, 4)
+	binary.LittleEndian.PutUint32(sr, sampleRate)
+	b = append(b, sr...)
+	return append(b, 0, 0, 0) // Output gain and channel mapping family
+}
+
+type webmTrack struct {
+	number   uint64
+	kind     string
+	codecID  string
+	width    uint64
+	height   uint64
+	channels uint8
+}
+
+type webmFrame struct {
+	track     *webmTrack
+	timestamp int64
+	keyframe  bool
+	data      []byte
+}
+
+// webmWriter writes audio and video frames to a WebM file.
+// The segment has an unknown size and clusters are written once complete,
+// so a file cut off at any point is still playable.
+// It is not safe for concurrent use.
+type webmWriter struct {
+	file *os.File
+
+	tracks        map[string]*webmTrack
+	headerWritten bool
+	pending       []*webmFrame
+
+	cluster      []*webmFrame
+	clusterStart int64
+}
+
+// addTrack declares a track. New tracks can not be added once the header
+// is written, the caller has to start a new file for them.
+func (w *webmWriter) addTrack(track *webmTrack) bool {
+	if _, ok := w.tracks[track.kind]; ok {
+		return true
+	}
+	if w.headerWritten {
+		return false
+	}
+	track.number = uint64(len(w.tracks) + 1)
+	w.tracks[track.kind] = track
+	return true
+}
+
+// writeFrame adds a frame of the given track kind. `timestamp` is in
+// milliseconds from the start of the file.
+func (w *webmWriter) writeFrame(kind string, timestamp int64, keyframe bool, data []byte) error {
+	track, ok := w.tracks[kind]
+	if !ok {
+		return nil
+	}
+	frame := &webmFrame{track: track, timestamp: timestamp, keyframe: keyframe, data: data}
+
+	if !w.headerWritten {
+		w.pending = append(w.pending, frame)
+		if len(w.tracks) < 2 && timestamp-w.pending[0].timestamp < webmHeaderTimeout {
+			return nil
+		}
+		return w.writePending()
+	}
+
+	return w.addToCluster(frame)
+}
+
+func (w *webmWriter) writePending() error {
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+
+	sort.SliceStable(w.pending, func(i, j int) bool {
+		return w.pending[i].timestamp < w.pending[j].timestamp
+	})
+	for _, frame := range w.pending {
+		if err := w.addToCluster(frame); err != nil {
+			return err
+		}
+	}
+	w.pending = nil
+	return nil
+}
+
+func (w *webmWriter) writeHeader() error {
+	w.headerWritten = true
+
+	header := ebmlMaster(ebmlIDHeader,
+		ebmlUint(ebmlIDVersion, 1),
+		ebmlUint(ebmlIDReadVersion, 1),
+		ebmlUint(ebmlIDMaxIDLength, 4),
+		ebmlUint(ebmlIDMaxSizeLength, 8),
+		ebmlString(ebmlIDDocType, "webm"),
+		ebmlUint(ebmlIDDocTypeVersion, 4),
+		ebmlUint(ebmlIDDocTypeReadVersion, 2),
+	)
+
+	info := ebmlMaster(mkvIDInfo,
+		ebmlUint(mkvIDTimecodeScale, 1000000), // 1ms
+		ebmlString(mkvIDMuxingApp, "video-democry"),
+		ebmlString(mkvIDWritingApp, "video-democry"),
+	)
+
+	entries := [][]byte{}
+	for _, kind := range []string{"audio", "video"} {
+		track, ok := w.tracks[kind]
+		if !ok {
+			continue
+		}
+
+		fields := [][]byte{
+			ebmlUint(mkvIDTrackNumber, track.number),
+			ebmlUint(mkvIDTrackUID, track.number),
+			ebmlString(mkvIDCodecID, track.codecID),
+		}
+		if kind == "video" {
+			fields = append(fields,
+				ebmlUint(mkvIDTrackType, mkvTrackTypeVideo),
+				ebmlMaster(mkvIDVideo,
+					ebmlUint(mkvIDPixelWidth, track.width),
+					ebmlUint(mkvIDPixelHeight, track.height),
+				),
+			)
+		} else {
+			fields = append(fields,
+				ebmlUint(mkvIDTrackType, mkvTrackTypeAudio),
+				ebmlElement(mkvIDCodecPrivate, opusHead(track.channels, 48000)),
+				ebmlMaster(mkvIDAudio,
+					ebmlFloat(mkvIDSamplingFrequency, 48000),
+					ebmlUint(mkvIDChannels, uint64(track.channels)),
+				),
+			)
+		}
+		entries = append(entries, ebmlMaster(mkvIDTrackEntry, fields...))
+	}
+
+	segment := append(ebmlID(mkvIDSegment), ebmlUnknownSize...)
+
+	_, err := w.file.Write(bytes.Join([][]byte{
+		header,
+		segment,
+		info,
+		ebmlMaster(mkvIDTracks, entries...),
+	}, nil))
+	return err
+}
+
+func (w *webmWriter) addToCluster(frame *webmFrame) error {
+	if len(w.cluster) > 0 {
+		elapsed := frame.timestamp - w.clusterStart
+		// Start clusters on video keyframes so players can seek, and keep
+		// block timecodes in range.
+		newCluster := elapsed >= webmClusterDuration ||
+			elapsed < math.MinInt16 || elapsed > math.MaxInt16 ||
+			(frame.keyframe && frame.track.kind == "video" && elapsed > 1000)
+		if newCluster {
+			if err := w.flushCluster(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(w.cluster) == 0 {
+		w.clusterStart = frame.timestamp
+	}
+	w.cluster = append(w.cluster, frame)
+	return nil
+}
+
+func (w *webmWriter) flushCluster() error {
+	if len(w.cluster) == 0 {
+		return nil
+	}
+
+	blocks := [][]byte{ebmlUint(mkvIDTimecode, uint64(w.clusterStart))}
+	for _, frame := range w.cluster {
+		block := make([]byte, 4, 4+len(frame.data))
+		block[0] = 0x80 | byte(frame.track.number)
+		binary.BigEndian.PutUint16(block[1:], uint16(int16(frame.timestamp-w.clusterStart)))
+		if frame.keyframe {
+			block[3] = 0x80
+		}
+		blocks = append(blocks, ebmlElement(mkvIDSimpleBlock, append(block, frame.data...)))
+	}
+	w.cluster = nil
+
+	_, err := w.file.Write(ebmlMaster(mkvIDCluster, blocks...))
+	return err
+}
+
+func (w *webmWriter) close() error {
+	if !w.headerWritten && len(w.pending) > 0 {
+		if err := w.writePending(); err != nil {
+			w.file.Close()
+			return err
+		}
+	}
+	if err := w.flushCluster(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+func newWebMWriter(fileName string) (*webmWriter, error) {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &webmWriter{
+		file:   file,
+		tracks: map[string]*webmTrack{},
+	}, nil
+}
@@ -0,0 +1,50 @@
+package chap7
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebMWriter_ebmlSize(t *testing.T) {
+	assert.Equal(t, []byte{0x81}, ebmlSize(1))
+	assert.Equal(t, []byte{0x40, 0x7F}, ebmlSize(127))
+	assert.Equal(t, []byte{0x41, 0x00}, ebmlSize(256))
+	assert.Equal(t, []byte{0x20, 0x40, 0x00}, ebmlSize(16384))
+}
+
+func TestWebMWriter_writesHeaderAndClusters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webm")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	fileName := path.Join(dir, "test.webm")
+	w, err := newWebMWriter(fileName)
+	assert.Nil(t, err)
+
+	assert.True(t, w.addTrack(&webmTrack{kind: "audio", codecID: "A_OPUS", channels: 2}))
+	assert.True(t, w.addTrack(&webmTrack{kind: "video", codecID: "V_VP8", width: 640, height: 480}))
+
+	assert.Nil(t, w.writeFrame("audio", 0, true, []byte{1, 2, 3}))
+	assert.Nil(t, w.writeFrame("video", 10, true, []byte{4, 5, 6}))
+	assert.Nil(t, w.writeFrame("audio", 20, true, []byte{7, 8, 9}))
+
+	// Tracks can not be added once the header is out.
+	assert.False(t, w.addTrack(&webmTrack{kind: "screen", codecID: "V_VP8"}))
+
+	assert.Nil(t, w.close())
+
+	data, err := ioutil.ReadFile(fileName)
+	assert.Nil(t, err)
+
+	assert.True(t, bytes.HasPrefix(data, ebmlID(ebmlIDHeader)))
+	assert.True(t, bytes.Contains(data, []byte("webm")))
+	assert.True(t, bytes.Contains(data, []byte("V_VP8")))
+	assert.True(t, bytes.Contains(data, []byte("OpusHead")))
+	assert.True(t, bytes.Contains(data, ebmlID(mkvIDCluster)))
+	assert.True(t, bytes.HasSuffix(data, []byte{7, 8, 9}))
+}
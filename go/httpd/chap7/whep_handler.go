@@ -0,0 +1,150 @@
+package chap7
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+
+	"github.com/gorilla/mux"
+	"github.com/pion/webrtc/v3"
+
+	"github.com/andrefsp/video-democry/go/httpd/responses"
+)
+
+// WHEPPlay lets a WHEP player watch a publisher of the room, given by
+// `publisher`, or follow the active speaker.
+func (s *chap7Handler) WHEPPlay(w http.ResponseWriter, req *http.Request) {
+	roomID := req.URL.Query().Get("room")
+	if roomID == "" {
+		responses.Send(w, http.StatusBadRequest, responses.NewError("room not present on request"))
+		return
+	}
+
+	if _, err := s.roomClaims(roomID, bearerToken(req)); err != nil {
+		responses.Send(w, tokenErrorStatus(err), responses.NewError(err.Error()))
+		return
+	}
+
+	r := s.roomFactory.get(roomID)
+	if r == nil {
+		responses.Send(w, http.StatusNotFound, responses.NewError(ErrRoomNotFound.Error()))
+		return
+	}
+
+	publisherID := req.URL.Query().Get("publisher")
+	publisher := r.defaultPublisher()
+	if publisherID != "" {
+		publisher = r.getUserByID(publisherID)
+	}
+	if publisher == nil || len(publisher.getVideoLayers()) == 0 {
+		responses.Send(w, http.StatusNotFound, responses.NewError("no video to watch in the room"))
+		return
+	}
+
+	offer, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		responses.Send(w, http.StatusBadRequest, responses.NewError(err.Error()))
+		return
+	}
+
+	me, err := getPublisherMediaEngine()
+	if err != nil {
+		responses.Send(w, http.StatusInternalServerError, responses.NewError(err.Error()))
+		return
+	}
+	pc, err := s.userFactory.newPeerConnection(me)
+	if err != nil {
+		responses.Send(w, http.StatusInternalServerError, responses.NewError(err.Error()))
+		return
+	}
+
+	// The id addresses the WHEP resource, only the viewer knows it.
+	id, err := newSecret()
+	if err != nil {
+		pc.Close()
+		responses.Send(w, http.StatusInternalServerError, responses.NewError(err.Error()))
+		return
+	}
+
+	v, err := newViewer(id, pc, publisher)
+	if err != nil {
+		pc.Close()
+		responses.Send(w, http.StatusInternalServerError, responses.NewError(err.Error()))
+		return
+	}
+	v.followSpeaker = publisherID == ""
+
+	answer, err := whipAnswer(req.Context(), pc, string(offer))
+	if err != nil {
+		v.close()
+		responses.Send(w, http.StatusBadRequest, responses.NewError(err.Error()))
+		return
+	}
+
+	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		log.Printf("ICE state `%s` with viewer `%s`", state.String(), v.ID)
+		if state == webrtc.ICEConnectionStateFailed {
+			if r.removeViewer(v.ID) != nil {
+				v.close()
+			}
+		}
+	})
+
+	r.addViewer(v)
+	v.setPublisher(publisher)
+
+	log.Printf("Viewer `%s` joined room `%s`", v.ID, r.ID)
+
+	w.Header().Set("Location", path.Join(req.URL.Path, roomID, v.ID))
+	w.Header().Set("Content-Type", "application/sdp")
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(answer))
+}
+
+// WHEPResource trickles ICE candidates to a viewer on PATCH and closes it
+// on DELETE.
+func (s *chap7Handler) WHEPResource(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	if _, err := s.roomClaims(vars["room"], bearerToken(req)); err != nil {
+		responses.Send(w, tokenErrorStatus(err), responses.NewError(err.Error()))
+		return
+	}
+
+	r := s.roomFactory.get(vars["room"])
+	if r == nil {
+		responses.Send(w, http.StatusNotFound, responses.NewError(ErrRoomNotFound.Error()))
+		return
+	}
+
+	if req.Method == http.MethodDelete {
+		v := r.removeViewer(vars["resource"])
+		if v == nil {
+			responses.Send(w, http.StatusNotFound, responses.NewError(ErrViewerNotFound.Error()))
+			return
+		}
+		v.close()
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	v := r.getViewer(vars["resource"])
+	if v == nil {
+		responses.Send(w, http.StatusNotFound, responses.NewError(ErrViewerNotFound.Error()))
+		return
+	}
+
+	fragment, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		responses.Send(w, http.StatusBadRequest, responses.NewError(err.Error()))
+		return
+	}
+
+	for _, c := range parseSDPFragment(string(fragment)) {
+		if err := v.pc.AddICECandidate(c); err != nil {
+			log.Printf("Error adding ICECandidate(%s): (%+v)\n", err.Error(), c)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
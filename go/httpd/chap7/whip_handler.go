@@ -0,0 +1,222 @@
+package chap7
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+
+	"github.com/andrefsp/video-democry/go/httpd/responses"
+)
+
+// WHIPPublish ingests the media of a WHIP client (RFC 9725) into a room as
+// a publish-only user. The answer carries every ICE candidate and the
+// Location of the resource to trickle candidates to and to delete.
+func (s *chap7Handler) WHIPPublish(w http.ResponseWriter, req *http.Request) {
+	roomID := req.URL.Query().Get("room")
+	if roomID == "" {
+		responses.Send(w, http.StatusBadRequest, responses.NewError("room not present on request"))
+		return
+	}
+
+	claims, err := s.roomClaims(roomID, bearerToken(req))
+	if err != nil {
+		responses.Send(w, tokenErrorStatus(err), responses.NewError(err.Error()))
+		return
+	}
+
+	username, role := req.URL.Query().Get("name"), rolePublisher
+	if claims != nil {
+		username, role = claims.Name, claims.Role
+	}
+	if role == roleSubscriber {
+		responses.Send(w, http.StatusForbidden, responses.NewError("token does not allow publishing"))
+		return
+	}
+
+	offer, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		responses.Send(w, http.StatusBadRequest, responses.NewError(err.Error()))
+		return
+	}
+
+	r := s.roomFactory.getOrCreate(roomID, roomSettings{})
+	if r.needsAdmission(role) {
+		s.roomFactory.deleteIfEmpty(r)
+		responses.Send(w, http.StatusForbidden, responses.NewError("room has a lobby"))
+		return
+	}
+
+	user, err := s.userFactory.newUser(&user{
+		ID:       uuid.New().String(),
+		Username: username,
+		Role:     role,
+	})
+	if err != nil {
+		s.roomFactory.deleteIfEmpty(r)
+		responses.Send(w, http.StatusInternalServerError, responses.NewError(err.Error()))
+		return
+	}
+	user.ingest = true
+	user.StreamID = user.ID
+	if user.resource, err = newSecret(); err != nil {
+		user.stop()
+		s.roomFactory.deleteIfEmpty(r)
+		responses.Send(w, http.StatusInternalServerError, responses.NewError(err.Error()))
+		return
+	}
+
+	// Only used as the key of the user in the room.
+	conn := &websocket.Conn{}
+
+	if _, err := r.addUser(conn, user); err != nil {
+		user.stop()
+		s.roomFactory.deleteIfEmpty(r)
+		status := http.StatusServiceUnavailable
+		if err == ErrRoomLocked {
+			status = http.StatusForbidden
+		}
+		responses.Send(w, status, responses.NewError(err.Error()))
+		return
+	}
+
+	user.pc.OnTrack(func(t *webrtc.TrackRemote, rec *webrtc.RTPReceiver) {
+		s.handleTrack(r, user, t, rec)
+	})
+
+	// Without signaling the ICE connection can not be restarted.
+	user.pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		log.Printf("ICE state `%s` with WHIP user `%s`", state.String(), user.ID)
+		if state == webrtc.ICEConnectionStateFailed {
+			s.handleRoomDisconnection(r, conn)
+		}
+	})
+
+	answer, err := whipAnswer(req.Context(), user.pc, string(offer))
+	if err != nil {
+		s.handleRoomDisconnection(r, conn)
+		responses.Send(w, http.StatusBadRequest, responses.NewError(err.Error()))
+		return
+	}
+
+	s.announceJoin(r, user)
+
+	log.Printf("WHIP user `%s` publishing to room `%s`", user.ID, r.ID)
+
+	w.Header().Set("Location", path.Join(req.URL.Path, roomID, user.resource))
+	w.Header().Set("Content-Type", "application/sdp")
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(answer))
+}
+
+// How long a WHIP or WHEP answer waits on ICE gathering. The candidates
+// gathered after are left for the client to get without them.
+const whipGatheringTimeout = 3 * time.Second
+
+// whipAnswer answers the offer once ICE gathering is done, as WHIP clients
+// may not support trickle ICE. WHEP viewers are answered the same way.
+// It gives up when `ctx` is done, once the client is gone.
+func whipAnswer(ctx context.Context, pc *webrtc.PeerConnection, offer string) (string, error) {
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  offer,
+	}); err != nil {
+		return "", err
+	}
+
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return "", err
+	}
+
+	timeout := time.NewTimer(whipGatheringTimeout)
+	defer timeout.Stop()
+
+	select {
+	case <-gatherComplete:
+	case <-timeout.C:
+		log.Printf("ICE gathering not done after %s, answering with the candidates so far", whipGatheringTimeout)
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+
+	return pc.LocalDescription().SDP, nil
+}
+
+// WHIPResource trickles ICE candidates to a WHIP user on PATCH and takes
+// it out of the room on DELETE.
+func (s *chap7Handler) WHIPResource(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	if _, err := s.roomClaims(vars["room"], bearerToken(req)); err != nil {
+		responses.Send(w, tokenErrorStatus(err), responses.NewError(err.Error()))
+		return
+	}
+
+	r := s.roomFactory.get(vars["room"])
+	if r == nil {
+		responses.Send(w, http.StatusNotFound, responses.NewError(ErrRoomNotFound.Error()))
+		return
+	}
+
+	conn := r.getIngestConn(vars["resource"])
+	user := r.getUser(conn)
+	if user == nil {
+		responses.Send(w, http.StatusNotFound, responses.NewError(ErrUserNotFound.Error()))
+		return
+	}
+
+	if req.Method == http.MethodDelete {
+		s.handleRoomDisconnection(r, conn)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	fragment, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		responses.Send(w, http.StatusBadRequest, responses.NewError(err.Error()))
+		return
+	}
+
+	for _, c := range parseSDPFragment(string(fragment)) {
+		if err := user.pc.AddICECandidate(c); err != nil {
+			log.Printf("Error adding ICECandidate(%s): (%+v)\n", err.Error(), c)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseSDPFragment returns the candidates of a trickle ICE SDP fragment
+// (RFC 8840).
+func parseSDPFragment(fragment string) []webrtc.ICECandidateInit {
+	candidates := []webrtc.ICECandidateInit{}
+
+	mid := ""
+	for _, line := range strings.Split(fragment, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "a=mid:"):
+			mid = strings.TrimPrefix(line, "a=mid:")
+		case strings.HasPrefix(line, "a=candidate:"):
+			sdpMid := mid
+			candidates = append(candidates, webrtc.ICECandidateInit{
+				Candidate: strings.TrimPrefix(line, "a="),
+				SDPMid:    &sdpMid,
+			})
+		}
+	}
+	return candidates
+}
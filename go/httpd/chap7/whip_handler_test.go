@@ -0,0 +1,119 @@
+package chap7
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSDPFragment(t *testing.T) {
+	fragment := "a=ice-ufrag:EsAw\r\n" +
+		"a=ice-pwd:P2uYro0UCOQ4zxjKXaWCBui1\r\n" +
+		"m=audio 9 UDP/TLS/RTP/SAVPF 111\r\n" +
+		"a=mid:0\r\n" +
+		"a=candidate:1387637174 1 udp 2122260223 192.0.2.1 61764 typ host\r\n" +
+		"m=video 9 UDP/TLS/RTP/SAVPF 96\r\n" +
+		"a=mid:1\r\n" +
+		"a=candidate:3471623853 1 udp 2122194687 198.51.100.2 61765 typ host\r\n"
+
+	candidates := parseSDPFragment(fragment)
+	assert.Len(t, candidates, 2)
+	assert.Equal(t, "candidate:1387637174 1 udp 2122260223 192.0.2.1 61764 typ host", candidates[0].Candidate)
+	assert.Equal(t, "0", *candidates[0].SDPMid)
+	assert.Equal(t, "1", *candidates[1].SDPMid)
+
+	assert.Len(t, parseSDPFragment("a=end-of-candidates\r\n"), 0)
+}
+
+func sendWHIPRequest(t *testing.T, method, url, body string) *http.Response {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	assert.Nil(t, err)
+	req.Header.Set("Content-Type", "application/sdp")
+
+	res, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	res.Body.Close()
+	return res
+}
+
+func TestWHIP_resourceRoundTrip(t *testing.T) {
+	s := newTestHandler()
+	m := mux.NewRouter()
+	s.RegisterHandlers(m, nil)
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	assert.Nil(t, err)
+	defer pc.Close()
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: mimeTypeOpus}, "audio", "obs")
+	assert.Nil(t, err)
+	_, err = pc.AddTrack(track)
+	assert.Nil(t, err)
+	offer, err := pc.CreateOffer(nil)
+	assert.Nil(t, err)
+	assert.Nil(t, pc.SetLocalDescription(offer))
+
+	res, err := http.Post(srv.URL+"/whip?room=room&name=obs", "application/sdp", strings.NewReader(offer.SDP))
+	assert.Nil(t, err)
+	answer, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	assert.Contains(t, string(answer), "a=candidate:")
+
+	r := s.roomFactory.get("room")
+	if !assert.NotNil(t, r) {
+		return
+	}
+	users := r.getUserList()
+	assert.Len(t, users, 1)
+
+	location := res.Header.Get("Location")
+	assert.Equal(t, "/whip/room/"+users[0].resource, location)
+
+	// The participant ID, known to the room, does not address the resource.
+	res = sendWHIPRequest(t, http.MethodDelete, srv.URL+"/whip/room/"+users[0].ID, "")
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	fragment := "a=mid:0\r\na=candidate:1387637174 1 udp 2122260223 192.0.2.1 61764 typ host\r\n"
+	res = sendWHIPRequest(t, http.MethodPatch, srv.URL+location, fragment)
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+
+	res = sendWHIPRequest(t, http.MethodDelete, srv.URL+location, "")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Nil(t, s.roomFactory.get("room"))
+}
+
+func TestWHIPAnswer_clientGone(t *testing.T) {
+	offerer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	assert.Nil(t, err)
+	defer offerer.Close()
+	_, err = offerer.CreateDataChannel("data", nil)
+	assert.Nil(t, err)
+	offer, err := offerer.CreateOffer(nil)
+	assert.Nil(t, err)
+
+	// Gathering from an unreachable STUN server does not end before the
+	// STUN timeout.
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{
+		ICEServers: []webrtc.ICEServer{{URLs: []string{"stun:192.0.2.1:3478"}}},
+	})
+	assert.Nil(t, err)
+	defer pc.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now()
+	_, err = whipAnswer(ctx, pc, offer.SDP)
+	assert.Equal(t, context.Canceled, err)
+	assert.True(t, time.Since(start) < time.Second)
+}
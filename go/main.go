@@ -7,6 +7,8 @@ import (
 	"os"
 	"path"
 	"runtime"
+	"strconv"
+	"time"
 
 	"github.com/andrefsp/video-democry/go/config"
 	"github.com/andrefsp/video-democry/go/netutils"
@@ -52,8 +54,22 @@ var sslDir = "ssl/"
 
 var staticDir = relPath("../fe/src/")
 
+var recordingsDir = valueOrDefault(os.Getenv("RECORDINGS_DIR"), relPath("recordings/"))
+
 var hostname = valueOrDefault(os.Getenv("V_HOSTNAME"), "localhost")
 
+var maxRoomSize = getMaxRoomSize()
+
+var lastN = getLastN()
+
+var resumeGracePeriod = getResumeGracePeriod()
+
+var tokenSecret = os.Getenv("TOKEN_SECRET")
+
+var stunServerAddr = valueOrDefault(os.Getenv("STUN_SERVER_ADDR"), "stun:stun.l.google.com:19302")
+
+var operatorSecret = os.Getenv("OPERATOR_SECRET")
+
 // Replace it with IP address of network interface.
 var relayAddr = valueOrDefault(os.Getenv("RELAY_ADDR"), getRelayAddr())
 
@@ -65,6 +81,30 @@ func getRelayAddr() string {
 	return addr
 }
 
+func getMaxRoomSize() int {
+	size, err := strconv.Atoi(valueOrDefault(os.Getenv("MAX_ROOM_SIZE"), "10"))
+	if err != nil {
+		panic(err)
+	}
+	return size
+}
+
+func getLastN() int {
+	n, err := strconv.Atoi(valueOrDefault(os.Getenv("LAST_N"), "0"))
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func getResumeGracePeriod() time.Duration {
+	seconds, err := strconv.Atoi(valueOrDefault(os.Getenv("RESUME_GRACE_PERIOD"), "30"))
+	if err != nil {
+		panic(err)
+	}
+	return time.Duration(seconds) * time.Second
+}
+
 func getStunTurnAddr() string {
 	if hostname == "localhost" {
 		return fmt.Sprintf("turn:%s:3478", relayAddr)
@@ -81,11 +121,19 @@ func main() {
 		Hostname:       hostname,
 		Port:           listenPort,
 		TurnServerAddr: getStunTurnAddr(),
+		StunServerAddr: stunServerAddr,
+		MaxRoomSize:    maxRoomSize,
+		LastN:          lastN,
+		RecordingsDir:  recordingsDir,
+
+		ResumeGracePeriod: resumeGracePeriod,
+		TokenSecret:       tokenSecret,
+		OperatorSecret:    operatorSecret,
 	})
 
 	fullListenAddr := fmt.Sprintf("%s:%s", listenAddr, listenPort)
 
-	log.Printf("hostname: '%s' serving on '%s' sslMode: %t", fullListenAddr, sslMode)
+	log.Printf("hostname: '%s' serving on '%s' sslMode: %t", hostname, fullListenAddr, sslMode)
 	switch sslMode {
 	case true:
 		log.Println("Serving over https")